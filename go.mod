@@ -1,6 +1,6 @@
 module github.com/MarshallWace/slurm-exporter
 
-go 1.17
+go 1.18
 
 require (
 	github.com/go-ldap/ldif v0.0.0-20200320164324-fd88d9b715b3
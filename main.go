@@ -8,11 +8,10 @@ import (
 	"net/http"
 
 	"log"
+	"time"
 
 	"github.com/MarshallWace/slurm-exporter/pkg/slurm"
-	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 const (
@@ -33,11 +32,111 @@ var gpuAcct = flag.Bool(
 	false,
 	"Enable GPUs accounting")
 
+var controllerPing = flag.Bool(
+	"controller-ping",
+	true,
+	"Report slurmctld and slurmdbd reachability with scontrol ping and sacctmgr ping")
+
+var finishedJobs = flag.Bool(
+	"finished-jobs",
+	false,
+	"Account for finished jobs with sacct")
+
+var jobEfficiency = flag.Bool(
+	"job-efficiency",
+	false,
+	"Compute the CPU and memory efficiency of finished jobs with sacct")
+
+var sstat = flag.Bool(
+	"sstat",
+	false,
+	"Report the live resource usage of running jobs with sstat")
+
+var sstatMaxJobs = flag.Int(
+	"sstat-max-jobs",
+	100,
+	"Maximum number of running jobs queried with sstat per scrape, 0 means all of them")
+
+var reservations = flag.Bool(
+	"reservations",
+	false,
+	"Report reservations with scontrol show reservation")
+
+var licenses = flag.Bool(
+	"licenses",
+	false,
+	"Report licenses with scontrol show licenses")
+
+var qos = flag.Bool(
+	"qos",
+	false,
+	"Report QOS limits and usage with sacctmgr show qos")
+
+var associations = flag.Bool(
+	"associations",
+	false,
+	"Report association limits and usage with sacctmgr show assoc")
+
+var sprio = flag.Bool(
+	"sprio",
+	false,
+	"Report the priority factors of pending jobs with sprio")
+
+var sprioMaxSeries = flag.Int(
+	"sprio-max-series",
+	0,
+	"Maximum number of per job priority series, 0 only reports the distributions per partition and account")
+
+var dbdStats = flag.Bool(
+	"dbd-stats",
+	false,
+	"Report the rollup and RPC statistics of slurmdbd with sacctmgr show stats")
+
+var jobArrays = flag.String(
+	"job-arrays",
+	slurm.JobArraysTasks,
+	"How array jobs are reported: one series per task (tasks), per array (aggregate) or both")
+
+var pendingReasons = flag.String(
+	"pending-reasons",
+	"",
+	"File of Reason=category lines overriding the categories of the reasons of pending jobs")
+
+var stateDir = flag.String(
+	"state-dir",
+	"",
+	"Directory where collectors keep their state across restarts, e.g. the last finished job accounted for")
+
 var execTimeoutSeconds = flag.Int(
 	"exec-timeout",
 	10,
 	"Timeout when executing shell commands")
 
+var scrapeTimeoutOffset = flag.Duration(
+	"scrape-timeout-offset",
+	500*time.Millisecond,
+	"Offset to subtract from the scrape timeout announced by Prometheus")
+
+var maxConcurrentCommands = flag.Int(
+	"max-concurrent-commands",
+	0,
+	"Maximum number of Slurm commands running at the same time, 0 means no limit")
+
+var breakerThreshold = flag.Int(
+	"breaker-threshold",
+	0,
+	"Stop running Slurm commands after this many consecutive timeouts, 0 disables the circuit breaker")
+
+var breakerMinBackoff = flag.Duration(
+	"breaker-min-backoff",
+	30*time.Second,
+	"Time to wait before probing slurmctld again once the circuit breaker opened")
+
+var breakerMaxBackoff = flag.Duration(
+	"breaker-max-backoff",
+	10*time.Minute,
+	"Maximum time to wait between two probes while the circuit breaker is open")
+
 var nodeAddressSuffix = flag.String(
 	"address-suffix",
 	"",
@@ -57,28 +156,51 @@ func main() {
 	flag.Parse()
 	fmt.Println(appropriateLegalNotice)
 
-	if *gpuAcct {
-		prometheus.MustRegister(slurm.NewGPUsCollector()) // from gpus.go
-	}
 	if *ldapServer != "" && *ldapBaseSearch == "" {
 		log.Fatalln("--ldap-address is configured but --ldap-base-search is not. please configure --ldap-base-search (e.g. dc=example,dc=com) ")
 	}
 
-	reg, err := slurm.NewRegistry(*gpuAcct, *execTimeoutSeconds, *nodeAddressSuffix, *ldapServer, *ldapBaseSearch)
+	exporter, err := slurm.NewExporter(slurm.Config{
+		GPUAcct:               *gpuAcct,
+		ControllerPing:        *controllerPing,
+		FinishedJobs:          *finishedJobs,
+		JobEfficiency:         *jobEfficiency,
+		Sstat:                 *sstat,
+		SstatMaxJobs:          *sstatMaxJobs,
+		Reservations:          *reservations,
+		Licenses:              *licenses,
+		QOS:                   *qos,
+		Associations:          *associations,
+		Sprio:                 *sprio,
+		SprioMaxSeries:        *sprioMaxSeries,
+		DBDStats:              *dbdStats,
+		PendingReasonsFile:    *pendingReasons,
+		JobArrays:             *jobArrays,
+		StateDir:              *stateDir,
+		ExecTimeoutSeconds:    *execTimeoutSeconds,
+		NodeAddressSuffix:     *nodeAddressSuffix,
+		LDAPServer:            *ldapServer,
+		LDAPBaseSearch:        *ldapBaseSearch,
+		ScrapeTimeoutOffset:   *scrapeTimeoutOffset,
+		MaxConcurrentCommands: *maxConcurrentCommands,
+		BreakerThreshold:      *breakerThreshold,
+		BreakerMinBackoff:     *breakerMinBackoff,
+		BreakerMaxBackoff:     *breakerMaxBackoff,
+	})
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	// Adding more collectors to the registry
-	reg.MustRegister(
+	// Adding more collectors to the exporter
+	exporter.MustRegister(
 		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
 		collectors.NewGoCollector(),
 	)
 
-	// The Handler function provides a default handler to expose metrics
-	// via an HTTP server. "/metrics" is the usual endpoint for that.
+	// The exporter binds the Slurm commands of every scrape to its HTTP
+	// request. "/metrics" is the usual endpoint for that.
 	log.Printf("Starting Server: %s", *listenAddress)
 	log.Printf("GPUs Accounting: %t", *gpuAcct)
-	http.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	http.Handle("/metrics", exporter)
 	log.Fatal(http.ListenAndServe(*listenAddress, nil))
 }
@@ -3,6 +3,7 @@
 package slurm
 
 import (
+	"context"
 	"regexp"
 	"strconv"
 	"strings"
@@ -17,8 +18,8 @@ type JobMetrics struct {
 	suspended    float64
 }
 
-func ParseAccountsMetrics() map[string]*JobMetrics {
-	out := execCommand("squeue -a -r -h -o %A|%a|%T|%C")
+func ParseAccountsMetrics(ctx context.Context) map[string]*JobMetrics {
+	out := execCommand(ctx, "squeue -a -r -h -o %i|%a|%T|%C")
 
 	accounts := make(map[string]*JobMetrics)
 	lines := strings.Split(out, "\n")
@@ -32,6 +33,13 @@ func ParseAccountsMetrics() map[string]*JobMetrics {
 			state := strings.Split(line, "|")[2]
 			state = strings.ToLower(state)
 			cpus, _ := strconv.ParseFloat(strings.Split(line, "|")[3], 64)
+			// The other components of a heterogeneous job only add CPUs
+			if hetJobComponent(strings.Split(line, "|")[0]) {
+				if strings.HasPrefix(state, "running") {
+					accounts[account].running_cpus += cpus
+				}
+				continue
+			}
 			pending := regexp.MustCompile(`^pending`)
 			running := regexp.MustCompile(`^running`)
 			suspended := regexp.MustCompile(`^suspended`)
@@ -73,8 +81,8 @@ func (ac *AccountsCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- ac.suspended
 }
 
-func (ac *AccountsCollector) Collect(ch chan<- prometheus.Metric) {
-	am := ParseAccountsMetrics()
+func (ac *AccountsCollector) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	am := ParseAccountsMetrics(ctx)
 	for a := range am {
 		if am[a].pending > 0 {
 			ch <- prometheus.MustNewConstMetric(ac.pending, prometheus.GaugeValue, am[a].pending, a)
@@ -0,0 +1,273 @@
+// SPDX-FileCopyrightText: 2022 2022 Marshall Wace <opensource@mwam.com>
+//
+// SPDX-License-Identifier: GPL3
+
+package slurm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	assocTestData         = "test_data/assoc.txt"
+	clusterConfigCommand  = "scontrol show config"
+	clusterConfigTestData = "test_data/scontrol_config.txt"
+	// GrpTRESRaw is the decayed usage in TRES minutes GrpTRESMins is
+	// enforced against
+	assocTRESMinsCommand  = "sshare -a -n -P -m -o Account,User,Partition,GrpTRESRaw"
+	assocTRESMinsTestData = "test_data/sshare_assoc.txt"
+)
+
+var (
+	assocFields  = []string{"Cluster", "Account", "User", "Partition", "ParentName", "GrpTRES", "GrpJobs", "GrpSubmitJobs", "MaxJobs", "MaxSubmitJobs", "GrpTRESMins"}
+	assocCommand = "sacctmgr show assoc -n -P format=" + strings.Join(assocFields, ",")
+	// Limits of an association, by sacctmgr field
+	assocLimits     = []string{"GrpJobs", "GrpSubmitJobs", "MaxJobs", "MaxSubmitJobs"}
+	assocTRESLimits = []string{"GrpTRES", "GrpTRESMins"}
+)
+
+type AssocMetrics struct {
+	account   string
+	user      string
+	partition string
+	// Limits which are set, by sacctmgr field and then TRES
+	limits     map[string]float64
+	tresLimits map[string]map[string]float64
+	// Usage of the jobs subject to the association: jobs of the account and
+	// its sub-accounts, or jobs of the user in the account
+	running   float64
+	submitted float64
+	tres      map[string]float64
+	// TRES minutes used by the association, as reported by sshare
+	tresMins map[string]float64
+}
+
+// assocUsage sums the running and pending jobs by association key.
+type assocUsage struct {
+	running   map[string]float64
+	submitted map[string]float64
+	tres      map[string]map[string]float64
+}
+
+func (u *assocUsage) add(key string, running bool, tres map[string]float64) {
+	u.submitted[key]++
+	if running {
+		u.running[key]++
+		addTRES(u.tres, key, tres)
+	}
+}
+
+func assocKey(account, user, partition string) string {
+	return account + "|" + user + "|" + partition
+}
+
+// parseClusterName extracts ClusterName from the output of `scontrol show
+// config`.
+func parseClusterName(out string) string {
+	for _, line := range strings.Split(out, "\n") {
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) == 2 && strings.TrimSpace(kv[0]) == "ClusterName" {
+			return strings.TrimSpace(kv[1])
+		}
+	}
+	return ""
+}
+
+// clusterName returns the name of the cluster of the exporter, looked up
+// until it is known.
+func (ac *AssocCollector) clusterName(ctx context.Context) string {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if ac.cluster == "" {
+		ac.cluster = parseClusterName(getData(ctx, ac.isTest, clusterConfigCommand, clusterConfigTestData))
+	}
+	return ac.cluster
+}
+
+func (ac *AssocCollector) AssocGetMetrics(ctx context.Context) []*AssocMetrics {
+	var assocs []*AssocMetrics
+	// slurmdbd may serve several clusters, while the usage comes from the
+	// jobs of the local one
+	cluster := ac.clusterName(ctx)
+	if cluster == "" {
+		err := fmt.Errorf("no ClusterName in %s", clusterConfigCommand)
+		ExporterErrors.WithLabelValues("cluster-name", err.Error()).Inc()
+		fmt.Println(err)
+		return assocs
+	}
+	parents := make(map[string]string)
+	out := getData(ctx, ac.isTest, assocCommand, assocTestData)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, "|")
+		if len(fields) < len(assocFields) {
+			continue
+		}
+		values := map[string]string{}
+		for i, field := range assocFields {
+			values[field] = fields[i]
+		}
+		if values["Cluster"] != cluster {
+			continue
+		}
+		am := &AssocMetrics{
+			account:    values["Account"],
+			user:       values["User"],
+			partition:  values["Partition"],
+			limits:     map[string]float64{},
+			tresLimits: map[string]map[string]float64{},
+		}
+		if am.user == "" {
+			parents[am.account] = values["ParentName"]
+		}
+		for _, field := range assocLimits {
+			if v, ok := parseLimit(field, values[field]); ok {
+				am.limits[field] = v
+			}
+		}
+		for _, field := range assocTRESLimits {
+			if values[field] != "" {
+				am.tresLimits[field] = parseTRES(values[field])
+			}
+		}
+		assocs = append(assocs, am)
+	}
+
+	tresMins := map[string]map[string]float64{}
+	out = getData(ctx, ac.isTest, assocTRESMinsCommand, assocTRESMinsTestData)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, "|")
+		if len(fields) < 4 {
+			continue
+		}
+		key := assocKey(strings.TrimSpace(fields[0]), fields[1], fields[2])
+		tresMins[key] = parseTRES(fields[3])
+	}
+
+	usage := &assocUsage{running: map[string]float64{}, submitted: map[string]float64{}, tres: map[string]map[string]float64{}}
+	// Unlike in the queue metrics, every component of a heterogeneous job
+	// counts as a job against the limits
+	for _, job := range getJobs(ctx, ac.isTest).Jobs {
+		var tres map[string]float64
+		switch job.JobState {
+		case "RUNNING":
+			tres = parseTRES(job.TresAllocStr)
+		case "PENDING":
+		default:
+			continue
+		}
+		running := job.JobState == "RUNNING"
+		usage.add(assocKey(job.Account, job.UserName, ""), running, tres)
+		usage.add(assocKey(job.Account, job.UserName, job.Partition), running, tres)
+		// Limits of an account apply to its sub-accounts too
+		account := job.Account
+		for depth := 0; account != "" && depth < 64; depth++ {
+			usage.add(assocKey(account, "", ""), running, tres)
+			account = parents[account]
+		}
+	}
+	for _, am := range assocs {
+		key := assocKey(am.account, am.user, am.partition)
+		if am.user == "" {
+			key = assocKey(am.account, "", "")
+		}
+		am.running = usage.running[key]
+		am.submitted = usage.submitted[key]
+		am.tres = usage.tres[key]
+		am.tresMins = tresMins[assocKey(am.account, am.user, am.partition)]
+	}
+	return assocs
+}
+
+/*
+ * Implement the Prometheus Collector interface and feed the
+ * Slurm association limits and usage into it.
+ * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
+ */
+
+type AssocCollector struct {
+	isTest          bool
+	mu              sync.Mutex
+	cluster         string
+	limits          map[string]*prometheus.Desc
+	tresLimits      map[string]*prometheus.Desc
+	utilization     map[string]*prometheus.Desc
+	tresUtilization *prometheus.Desc
+	tresMinsUtil    *prometheus.Desc
+}
+
+func NewAssocCollector(isTest bool) *AssocCollector {
+	labels := []string{"account", "user", "partition"}
+	tresLabels := append(labels, "tres")
+	return &AssocCollector{
+		isTest: isTest,
+		limits: map[string]*prometheus.Desc{
+			"GrpJobs":       prometheus.NewDesc("slurm_assoc_grp_jobs_limit", "Maximum running jobs of the association", labels, nil),
+			"GrpSubmitJobs": prometheus.NewDesc("slurm_assoc_grp_submit_jobs_limit", "Maximum running and pending jobs of the association", labels, nil),
+			"MaxJobs":       prometheus.NewDesc("slurm_assoc_max_jobs_limit", "Maximum running jobs per user of the association", labels, nil),
+			"MaxSubmitJobs": prometheus.NewDesc("slurm_assoc_max_submit_jobs_limit", "Maximum running and pending jobs per user of the association", labels, nil),
+		},
+		tresLimits: map[string]*prometheus.Desc{
+			"GrpTRES":     prometheus.NewDesc("slurm_assoc_grp_tres_limit", "Maximum TRES used by the running jobs of the association, memory in bytes", tresLabels, nil),
+			"GrpTRESMins": prometheus.NewDesc("slurm_assoc_grp_tres_mins_limit", "Maximum TRES minutes used by the jobs of the association", tresLabels, nil),
+		},
+		utilization: map[string]*prometheus.Desc{
+			"GrpJobs":       prometheus.NewDesc("slurm_assoc_grp_jobs_utilization", "Running jobs of the association over GrpJobs", labels, nil),
+			"GrpSubmitJobs": prometheus.NewDesc("slurm_assoc_grp_submit_jobs_utilization", "Running and pending jobs of the association over GrpSubmitJobs", labels, nil),
+			"MaxJobs":       prometheus.NewDesc("slurm_assoc_max_jobs_utilization", "Running jobs of the user association over MaxJobs", labels, nil),
+			"MaxSubmitJobs": prometheus.NewDesc("slurm_assoc_max_submit_jobs_utilization", "Running and pending jobs of the user association over MaxSubmitJobs", labels, nil),
+		},
+		tresUtilization: prometheus.NewDesc("slurm_assoc_grp_tres_utilization", "TRES used by the running jobs of the association over GrpTRES", tresLabels, nil),
+		tresMinsUtil:    prometheus.NewDesc("slurm_assoc_grp_tres_mins_utilization", "Decayed TRES minutes used by the association (GrpTRESRaw) over GrpTRESMins", tresLabels, nil),
+	}
+}
+
+func (ac *AssocCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, field := range assocLimits {
+		ch <- ac.limits[field]
+		ch <- ac.utilization[field]
+	}
+	for _, field := range assocTRESLimits {
+		ch <- ac.tresLimits[field]
+	}
+	ch <- ac.tresUtilization
+	ch <- ac.tresMinsUtil
+}
+
+func (ac *AssocCollector) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	for _, am := range ac.AssocGetMetrics(ctx) {
+		labelValues := []string{am.account, am.user, am.partition}
+		for field, value := range am.limits {
+			ch <- prometheus.MustNewConstMetric(ac.limits[field], prometheus.GaugeValue, value, labelValues...)
+			used := am.running
+			if field == "GrpSubmitJobs" || field == "MaxSubmitJobs" {
+				used = am.submitted
+			}
+			// MaxJobs and MaxSubmitJobs of an account are the defaults
+			// of its users, only meaningful for the user associations
+			if value > 0 && (am.user != "" || strings.HasPrefix(field, "Grp")) {
+				ch <- prometheus.MustNewConstMetric(ac.utilization[field], prometheus.GaugeValue, used/value, labelValues...)
+			}
+		}
+		for field, limits := range am.tresLimits {
+			for tres, value := range limits {
+				ch <- prometheus.MustNewConstMetric(ac.tresLimits[field], prometheus.GaugeValue, value, append(labelValues, tres)...)
+			}
+		}
+		for tres, value := range am.tresLimits["GrpTRES"] {
+			if value > 0 {
+				ch <- prometheus.MustNewConstMetric(ac.tresUtilization, prometheus.GaugeValue, am.tres[tres]/value, append(labelValues, tres)...)
+			}
+		}
+		// Associations unknown to sshare have no usage to report
+		for tres, value := range am.tresLimits["GrpTRESMins"] {
+			if used, ok := am.tresMins[tres]; ok && value > 0 {
+				ch <- prometheus.MustNewConstMetric(ac.tresMinsUtil, prometheus.GaugeValue, used/value, append(labelValues, tres)...)
+			}
+		}
+	}
+}
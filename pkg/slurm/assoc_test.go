@@ -0,0 +1,54 @@
+// SPDX-FileCopyrightText: 2022 2022 Marshall Wace <opensource@mwam.com>
+//
+// SPDX-License-Identifier: GPL3
+
+package slurm
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAssocGetMetrics(t *testing.T) {
+	collector := NewAssocCollector(true)
+	assocs := collector.AssocGetMetrics(context.Background())
+	// The associations of the other cluster served by slurmdbd are left out
+	assert.Equal(t, "main", parseClusterName(readFile(clusterConfigTestData)))
+	assert.Len(t, assocs, 7)
+	byKey := map[string]*AssocMetrics{}
+	for _, am := range assocs {
+		byKey[assocKey(am.account, am.user, am.partition)] = am
+	}
+
+	// science includes the jobs of physics and chemistry
+	science := byKey["science||"]
+	assert.Equal(t, 100.0, science.tresLimits["GrpTRES"]["cpu"])
+	assert.Equal(t, 600000.0, science.tresLimits["GrpTRESMins"]["cpu"])
+	assert.Equal(t, 4.0, science.running)
+	assert.Equal(t, 8.0, science.submitted)
+	assert.Equal(t, 29.0, science.tres["cpu"])
+	assert.Equal(t, 300000.0, science.tresMins["cpu"])
+
+	alice := byKey["physics|alice|"]
+	assert.Equal(t, map[string]float64{"MaxJobs": 2, "MaxSubmitJobs": 4}, alice.limits)
+	assert.Equal(t, 1.0, alice.running)
+	assert.Equal(t, 3.0, alice.submitted)
+
+	// Partition specific associations only see the jobs of the partition
+	bob := byKey["chemistry|bob|gpu"]
+	assert.Equal(t, 2.0, bob.tres["gres/gpu"])
+}
+
+func TestAssocCollector(t *testing.T) {
+	collector := &scrapeCollector{ctx: withScrapeCache(context.Background()), collector: NewAssocCollector(true)}
+	expected := `
+# HELP slurm_assoc_grp_tres_mins_utilization Decayed TRES minutes used by the association (GrpTRESRaw) over GrpTRESMins
+# TYPE slurm_assoc_grp_tres_mins_utilization gauge
+slurm_assoc_grp_tres_mins_utilization{account="science",partition="",tres="cpu",user=""} 0.5
+`
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(expected), "slurm_assoc_grp_tres_mins_utilization"))
+}
@@ -0,0 +1,195 @@
+// SPDX-FileCopyrightText: 2022 2022 Marshall Wace <opensource@mwam.com>
+//
+// SPDX-License-Identifier: GPL3
+
+package slurm
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+var (
+	errCircuitOpen = errors.New("circuit breaker open")
+
+	BreakerState = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Subsystem: "",
+			Name:      "slurm_exporter_circuit_breaker_state",
+			Help:      "State of the circuit breaker protecting slurmctld: 0 closed, 1 open, 2 half-open.",
+		})
+	BreakerTimeouts = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Subsystem: "",
+			Name:      "slurm_exporter_circuit_breaker_consecutive_timeouts",
+			Help:      "Number of consecutive exec commands that timed out.",
+		})
+	ExecInFlight = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Subsystem: "",
+			Name:      "slurm_exporter_exec_in_flight",
+			Help:      "Number of exec commands currently running.",
+		})
+	ExecRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: "",
+			Name:      "slurm_exporter_exec_rejected_total",
+			Help:      "Total number of exec commands not run because of the concurrency limit or the circuit breaker.",
+		},
+		[]string{"command", "reason"})
+
+	// Both are replaced by NewExporter according to the configuration, the
+	// zero values let every command through.
+	commandLimiter    = newLimiter(0)
+	controllerBreaker = newCircuitBreaker(0, 0, 0)
+)
+
+// limiter bounds the number of Slurm commands running at the same time.
+type limiter struct {
+	slots chan struct{}
+}
+
+// newLimiter returns a limiter allowing max concurrent commands, 0 meaning no
+// limit.
+func newLimiter(max int) *limiter {
+	if max <= 0 {
+		return &limiter{}
+	}
+	return &limiter{slots: make(chan struct{}, max)}
+}
+
+func (l *limiter) acquire(ctx context.Context) error {
+	if l.slots == nil {
+		return nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *limiter) release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+// circuitBreaker stops running Slurm commands after threshold consecutive
+// timeouts. Once open, a single probe command is let through after a backoff
+// which doubles every time the probe times out again, up to maxBackoff.
+type circuitBreaker struct {
+	mu         sync.Mutex
+	threshold  int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	state      int
+	timeouts   int
+	backoff    time.Duration
+	retryAt    time.Time
+	now        func() time.Time
+	// generation changes with the state, the outcome of the commands let
+	// through before is ignored: the commands of a scrape timing out
+	// together trip the breaker once, and only the probe closes it.
+	generation uint64
+}
+
+// newCircuitBreaker returns a breaker opening after threshold consecutive
+// timeouts, 0 disabling it.
+func newCircuitBreaker(threshold int, minBackoff, maxBackoff time.Duration) *circuitBreaker {
+	if maxBackoff < minBackoff {
+		maxBackoff = minBackoff
+	}
+	return &circuitBreaker{
+		threshold:  threshold,
+		minBackoff: minBackoff,
+		maxBackoff: maxBackoff,
+		now:        time.Now,
+	}
+}
+
+// allow reports whether a command may run. When it returns true the caller
+// must report the outcome of the command with done, along with the returned
+// generation.
+func (b *circuitBreaker) allow() (uint64, bool) {
+	if b.threshold <= 0 {
+		return 0, true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if b.now().Before(b.retryAt) {
+			return 0, false
+		}
+		b.setState(breakerHalfOpen)
+		return b.generation, true
+	case breakerHalfOpen:
+		// A probe is already in flight
+		return 0, false
+	}
+	return b.generation, true
+}
+
+// done records the outcome of a command let through by allow in generation.
+func (b *circuitBreaker) done(generation uint64, err error) {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if generation != b.generation {
+		return
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		b.timeouts++
+		if b.state == breakerHalfOpen || b.timeouts >= b.threshold {
+			b.trip()
+		}
+	case errors.Is(err, context.Canceled):
+		// The scrape went away before the command could tell anything
+		// about slurmctld; let the next command probe again.
+		if b.state == breakerHalfOpen {
+			b.retryAt = b.now()
+			b.setState(breakerOpen)
+		}
+	default:
+		b.timeouts = 0
+		b.backoff = 0
+		if b.state != breakerClosed {
+			b.setState(breakerClosed)
+		}
+	}
+	BreakerTimeouts.Set(float64(b.timeouts))
+}
+
+func (b *circuitBreaker) trip() {
+	if b.backoff == 0 {
+		b.backoff = b.minBackoff
+	} else {
+		b.backoff *= 2
+	}
+	if b.backoff > b.maxBackoff {
+		b.backoff = b.maxBackoff
+	}
+	b.retryAt = b.now().Add(b.backoff)
+	b.setState(breakerOpen)
+}
+
+func (b *circuitBreaker) setState(state int) {
+	b.state = state
+	b.generation++
+	BreakerState.Set(float64(state))
+}
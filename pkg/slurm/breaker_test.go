@@ -0,0 +1,116 @@
+// SPDX-FileCopyrightText: 2022 2022 Marshall Wace <opensource@mwam.com>
+//
+// SPDX-License-Identifier: GPL3
+
+package slurm
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := newCircuitBreaker(2, time.Minute, 3*time.Minute)
+	b.now = func() time.Time { return now }
+	run := func(err error) {
+		generation, ok := b.allow()
+		assert.True(t, ok)
+		b.done(generation, err)
+	}
+
+	// Errors other than timeouts reset the count
+	run(context.DeadlineExceeded)
+	run(errors.New("exit status 1"))
+	run(context.DeadlineExceeded)
+	assert.Equal(t, breakerClosed, b.state)
+
+	// The second consecutive timeout opens the breaker
+	run(context.DeadlineExceeded)
+	assert.Equal(t, breakerOpen, b.state)
+	_, ok := b.allow()
+	assert.False(t, ok)
+
+	// A single probe goes through once the backoff expired, and the backoff
+	// doubles each time it fails up to the maximum
+	for _, backoff := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		now = now.Add(backoff - time.Second)
+		_, ok = b.allow()
+		assert.False(t, ok)
+		now = now.Add(time.Second)
+		generation, ok := b.allow()
+		assert.True(t, ok)
+		_, ok = b.allow()
+		assert.False(t, ok)
+		b.done(generation, context.DeadlineExceeded)
+		assert.Equal(t, breakerOpen, b.state)
+	}
+
+	// A successful probe closes it
+	now = now.Add(3 * time.Minute)
+	run(nil)
+	assert.Equal(t, breakerClosed, b.state)
+	_, ok = b.allow()
+	assert.True(t, ok)
+}
+
+func TestCircuitBreakerConcurrentTimeouts(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := newCircuitBreaker(2, time.Minute, 3*time.Minute)
+	b.now = func() time.Time { return now }
+
+	// The commands of a scrape are let through before any of them times out
+	generations := make([]uint64, 5)
+	for i := range generations {
+		generation, ok := b.allow()
+		assert.True(t, ok)
+		generations[i] = generation
+	}
+	var wg sync.WaitGroup
+	for _, generation := range generations {
+		wg.Add(1)
+		go func(generation uint64) {
+			defer wg.Done()
+			b.done(generation, context.DeadlineExceeded)
+		}(generation)
+	}
+	wg.Wait()
+
+	// They trip the breaker once, with the minimum backoff
+	assert.Equal(t, breakerOpen, b.state)
+	assert.Equal(t, time.Minute, b.backoff)
+	assert.Equal(t, now.Add(time.Minute), b.retryAt)
+}
+
+func TestCircuitBreakerLateSuccess(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := newCircuitBreaker(1, time.Minute, 3*time.Minute)
+	b.now = func() time.Time { return now }
+
+	slow, ok := b.allow()
+	assert.True(t, ok)
+	generation, ok := b.allow()
+	assert.True(t, ok)
+	b.done(generation, context.DeadlineExceeded)
+	assert.Equal(t, breakerOpen, b.state)
+
+	// A command let through before the breaker opened does not close it
+	b.done(slow, nil)
+	assert.Equal(t, breakerOpen, b.state)
+	_, ok = b.allow()
+	assert.False(t, ok)
+
+	// Nor does it once the probe is in flight
+	now = now.Add(time.Minute)
+	probe, ok := b.allow()
+	assert.True(t, ok)
+	b.done(slow, nil)
+	assert.Equal(t, breakerHalfOpen, b.state)
+	b.done(probe, nil)
+	assert.Equal(t, breakerClosed, b.state)
+}
@@ -3,6 +3,7 @@
 package slurm
 
 import (
+	"context"
 	"strconv"
 	"strings"
 
@@ -21,9 +22,9 @@ type CPUsMetrics struct {
 	total float64
 }
 
-func (cc *CPUsCollector) CPUsGetMetrics() *CPUsMetrics {
+func (cc *CPUsCollector) CPUsGetMetrics(ctx context.Context) *CPUsMetrics {
 	var cm CPUsMetrics
-	out := getData(cc.isTest, CpuMetricsCommand, CpuMetricsTestData)
+	out := getData(ctx, cc.isTest, CpuMetricsCommand, CpuMetricsTestData)
 	if strings.Contains(out, "/") {
 		splitted := strings.Split(strings.TrimSpace(out), "/")
 		cm.alloc, _ = strconv.ParseFloat(splitted[0], 64)
@@ -65,8 +66,8 @@ func (cc *CPUsCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- cc.other
 	ch <- cc.total
 }
-func (cc *CPUsCollector) Collect(ch chan<- prometheus.Metric) {
-	cm := cc.CPUsGetMetrics()
+func (cc *CPUsCollector) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	cm := cc.CPUsGetMetrics(ctx)
 	ch <- prometheus.MustNewConstMetric(cc.alloc, prometheus.GaugeValue, cm.alloc)
 	ch <- prometheus.MustNewConstMetric(cc.idle, prometheus.GaugeValue, cm.idle)
 	ch <- prometheus.MustNewConstMetric(cc.other, prometheus.GaugeValue, cm.other)
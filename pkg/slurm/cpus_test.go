@@ -3,11 +3,12 @@
 package slurm
 
 import (
+	"context"
 	"testing"
 )
 
 func TestCPUsMetrics(t *testing.T) {
 	// Read the input data from a file
 	coll := NewCPUsCollector(true)
-	t.Logf("%+v", coll.CPUsGetMetrics())
+	t.Logf("%+v", coll.CPUsGetMetrics(context.Background()))
 }
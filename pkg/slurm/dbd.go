@@ -0,0 +1,207 @@
+// SPDX-FileCopyrightText: 2022 2022 Marshall Wace <opensource@mwam.com>
+//
+// SPDX-License-Identifier: GPL3
+
+package slurm
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	dbdStatsCommand  = "sacctmgr show stats"
+	dbdStatsTestData = "test_data/sacctmgr_stats.txt"
+)
+
+// dbdRollupField normalizes the rollup statistics of both layouts of
+// `sacctmgr show stats`: `count:8 ave_time:1146 ...` on the line of the period
+// up to Slurm 20.11, and one `Last cycle:   5042` line each since then.
+var dbdRollupField = map[string]string{
+	"count":        "cycles",
+	"ave_time":     "mean_cycle",
+	"max_time":     "max_cycle",
+	"total_time":   "total_time",
+	"Total cycles": "cycles",
+	"Mean cycle":   "mean_cycle",
+	"Max cycle":    "max_cycle",
+	"Total time":   "total_time",
+	"Last cycle":   "last_cycle",
+}
+
+// dbdRollupMetric exports a rollup statistic, cycle times are in
+// microseconds.
+type dbdRollupMetric struct {
+	field     string
+	name      string
+	help      string
+	valueType prometheus.ValueType
+	scale     float64
+}
+
+var dbdRollupMetrics = []dbdRollupMetric{
+	{"last_run", "slurm_dbd_rollup_last_run_timestamp_seconds", "Time of the last rollup since epoch", prometheus.GaugeValue, 1},
+	{"last_cycle", "slurm_dbd_rollup_last_duration_seconds", "Duration of the last rollup", prometheus.GaugeValue, 1e-6},
+	{"max_cycle", "slurm_dbd_rollup_max_duration_seconds", "Longest rollup since slurmdbd started", prometheus.GaugeValue, 1e-6},
+	{"mean_cycle", "slurm_dbd_rollup_mean_duration_seconds", "Mean duration of the rollups since slurmdbd started", prometheus.GaugeValue, 1e-6},
+	{"total_time", "slurm_dbd_rollup_duration_seconds_total", "Time spent in rollups since slurmdbd started", prometheus.CounterValue, 1e-6},
+	{"cycles", "slurm_dbd_rollups_total", "Number of rollups since slurmdbd started", prometheus.CounterValue, 1},
+}
+
+var (
+	// dbdLastRan matches `last ran Sat Oct 01 10:00:00 2022 (1664618400)`
+	dbdLastRan = regexp.MustCompile(`last ran .*\((\d+)\)`)
+	// dbdRPCLine matches `DBD_STEP_START ( 1442) count:56474 ave_time:281 total_time:15898147`
+	dbdRPCLine = regexp.MustCompile(`^(\S+)\s*\(\s*\d+\)\s+count:(\d+)\s+ave_time:\d+\s+total_time:(\d+)`)
+)
+
+type DBDStats struct {
+	// rollups maps the lower case period (hour, day, month) to the fields
+	// of dbdRollupMetrics which are set
+	rollups    map[string]map[string]float64
+	rpcsByType map[string]*RPCStats
+	rpcsByUser map[string]*RPCStats
+}
+
+// ParseDBDStats extracts the rollup and RPC statistics from the output of
+// `sacctmgr show stats`.
+func ParseDBDStats(out string) *DBDStats {
+	stats := &DBDStats{
+		rollups:    make(map[string]map[string]float64),
+		rpcsByType: make(map[string]*RPCStats),
+		rpcsByUser: make(map[string]*RPCStats),
+	}
+	var section string
+	var rollup map[string]float64
+	for _, line := range strings.Split(out, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "\t") && !strings.HasPrefix(line, " ") {
+			section = strings.TrimSpace(line)
+			rollup = nil
+			continue
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case section == "Rollup statistics":
+			rollup = parseDBDRollupLine(stats, rollup, line)
+		case strings.HasSuffix(section, "by message type"):
+			parseDBDRPCLine(stats.rpcsByType, line)
+		case strings.HasSuffix(section, "by user"):
+			parseDBDRPCLine(stats.rpcsByUser, line)
+		}
+	}
+	return stats
+}
+
+// parseDBDRollupLine adds a line of the rollup statistics to stats, and
+// returns the statistics of the period the following lines belong to.
+func parseDBDRollupLine(stats *DBDStats, rollup map[string]float64, line string) map[string]float64 {
+	fields := strings.Fields(line)
+	switch period := strings.ToLower(fields[0]); period {
+	case "hour", "day", "month":
+		rollup = make(map[string]float64)
+		stats.rollups[period] = rollup
+		if m := dbdLastRan.FindStringSubmatch(line); m != nil {
+			rollup["last_run"], _ = strconv.ParseFloat(m[1], 64)
+		}
+		for _, field := range fields[1:] {
+			kv := strings.SplitN(field, ":", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			if key, ok := dbdRollupField[kv[0]]; ok {
+				if v, err := strconv.ParseFloat(kv[1], 64); err == nil {
+					rollup[key] = v
+				}
+			}
+		}
+		return rollup
+	}
+	kv := strings.SplitN(line, ":", 2)
+	if rollup == nil || len(kv) != 2 {
+		return rollup
+	}
+	if key, ok := dbdRollupField[strings.TrimSpace(kv[0])]; ok {
+		if v, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64); err == nil {
+			rollup[key] = v
+		}
+	}
+	return rollup
+}
+
+// parseDBDRPCLine adds a line of the RPC statistics to rpcs, times are in
+// microseconds.
+func parseDBDRPCLine(rpcs map[string]*RPCStats, line string) {
+	m := dbdRPCLine.FindStringSubmatch(line)
+	if m == nil {
+		return
+	}
+	count, _ := strconv.ParseFloat(m[2], 64)
+	time, _ := strconv.ParseFloat(m[3], 64)
+	rpcs[m[1]] = &RPCStats{count: count, time: time / 1e6}
+}
+
+/*
+ * Implement the Prometheus Collector interface and feed the
+ * slurmdbd statistics into it.
+ * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
+ */
+
+type DBDCollector struct {
+	isTest          bool
+	rollup          map[string]*prometheus.Desc
+	rpcCalls        *prometheus.Desc
+	rpcDuration     *prometheus.Desc
+	userRPCCalls    *prometheus.Desc
+	userRPCDuration *prometheus.Desc
+}
+
+func NewDBDCollector(isTest bool) *DBDCollector {
+	rollup := make(map[string]*prometheus.Desc)
+	for _, m := range dbdRollupMetrics {
+		rollup[m.field] = prometheus.NewDesc(m.name, m.help, []string{"period"}, nil)
+	}
+	return &DBDCollector{
+		isTest:          isTest,
+		rollup:          rollup,
+		rpcCalls:        prometheus.NewDesc("slurm_dbd_rpc_calls_total", "Number of RPCs received by slurmdbd, by message type", []string{"type"}, nil),
+		rpcDuration:     prometheus.NewDesc("slurm_dbd_rpc_duration_seconds_total", "Time spent by slurmdbd processing RPCs, by message type", []string{"type"}, nil),
+		userRPCCalls:    prometheus.NewDesc("slurm_dbd_user_rpc_calls_total", "Number of RPCs received by slurmdbd, by user", []string{"user"}, nil),
+		userRPCDuration: prometheus.NewDesc("slurm_dbd_user_rpc_duration_seconds_total", "Time spent by slurmdbd processing RPCs, by user", []string{"user"}, nil),
+	}
+}
+
+func (dc *DBDCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, m := range dbdRollupMetrics {
+		ch <- dc.rollup[m.field]
+	}
+	ch <- dc.rpcCalls
+	ch <- dc.rpcDuration
+	ch <- dc.userRPCCalls
+	ch <- dc.userRPCDuration
+}
+
+func (dc *DBDCollector) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	stats := ParseDBDStats(getData(ctx, dc.isTest, dbdStatsCommand, dbdStatsTestData))
+	for period, rollup := range stats.rollups {
+		for _, m := range dbdRollupMetrics {
+			if v, ok := rollup[m.field]; ok {
+				ch <- prometheus.MustNewConstMetric(dc.rollup[m.field], m.valueType, v*m.scale, period)
+			}
+		}
+	}
+	for t, rpc := range stats.rpcsByType {
+		ch <- prometheus.MustNewConstMetric(dc.rpcCalls, prometheus.CounterValue, rpc.count, t)
+		ch <- prometheus.MustNewConstMetric(dc.rpcDuration, prometheus.CounterValue, rpc.time, t)
+	}
+	for user, rpc := range stats.rpcsByUser {
+		ch <- prometheus.MustNewConstMetric(dc.userRPCCalls, prometheus.CounterValue, rpc.count, user)
+		ch <- prometheus.MustNewConstMetric(dc.userRPCDuration, prometheus.CounterValue, rpc.time, user)
+	}
+}
@@ -0,0 +1,64 @@
+// SPDX-FileCopyrightText: 2022 2022 Marshall Wace <opensource@mwam.com>
+//
+// SPDX-License-Identifier: GPL3
+
+package slurm
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDBDStats(t *testing.T) {
+	stats := ParseDBDStats(readFile(dbdStatsTestData))
+	assert.Equal(t, map[string]float64{
+		"last_run":   1664618400,
+		"last_cycle": 5042,
+		"max_cycle":  107632,
+		"total_time": 2106245,
+		"cycles":     529,
+		"mean_cycle": 3981,
+	}, stats.rollups["hour"])
+	assert.Len(t, stats.rollups, 3)
+	assert.Len(t, stats.rpcsByType, 4)
+	assert.Equal(t, &RPCStats{count: 56474, time: 15.898147}, stats.rpcsByType["DBD_STEP_START"])
+	assert.Equal(t, &RPCStats{count: 31, time: 0.064648}, stats.rpcsByUser["root"])
+	// The name fills the padded width
+	assert.Equal(t, &RPCStats{count: 12, time: 0.018}, stats.rpcsByUser["svc_nightly_reporting"])
+
+	// Layout of Slurm 20.11 and older
+	stats = ParseDBDStats("Rollup statistics\n" +
+		"\tHour       count:8      ave_time:1146  max_time:2018      total_time:9169\n" +
+		"\tMonth      count:0      ave_time:0     max_time:0         total_time:0\n")
+	assert.Equal(t, map[string]float64{
+		"cycles":     8,
+		"mean_cycle": 1146,
+		"max_cycle":  2018,
+		"total_time": 9169,
+	}, stats.rollups["hour"])
+	assert.Equal(t, 0.0, stats.rollups["month"]["cycles"])
+}
+
+func TestDBDCollector(t *testing.T) {
+	collector := &scrapeCollector{ctx: context.Background(), collector: NewDBDCollector(true)}
+	expected := `
+# HELP slurm_dbd_rollup_duration_seconds_total Time spent in rollups since slurmdbd started
+# TYPE slurm_dbd_rollup_duration_seconds_total counter
+slurm_dbd_rollup_duration_seconds_total{period="day"} 1.043302
+slurm_dbd_rollup_duration_seconds_total{period="hour"} 2.106245
+slurm_dbd_rollup_duration_seconds_total{period="month"} 0.612004
+# HELP slurm_dbd_user_rpc_calls_total Number of RPCs received by slurmdbd, by user
+# TYPE slurm_dbd_user_rpc_calls_total counter
+slurm_dbd_user_rpc_calls_total{user="root"} 31
+slurm_dbd_user_rpc_calls_total{user="slurm"} 113918
+slurm_dbd_user_rpc_calls_total{user="svc_nightly_reporting"} 12
+`
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(expected),
+		"slurm_dbd_rollup_duration_seconds_total", "slurm_dbd_user_rpc_calls_total"))
+	// Every rollup statistic of the 3 periods, 4 message types and 3 users
+	assert.Equal(t, 3*len(dbdRollupMetrics)+2*4+2*3, testutil.CollectAndCount(collector))
+}
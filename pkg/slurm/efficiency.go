@@ -0,0 +1,233 @@
+// SPDX-FileCopyrightText: 2022 2022 Marshall Wace <opensource@mwam.com>
+//
+// SPDX-License-Identifier: GPL3
+
+package slurm
+
+import (
+	"context"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MarshallWace/slurm-exporter/pkg/ldapsearch"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// Steps are needed for MaxRSS, so no -X here
+	efficiencyCommand   = "sacct -a -n -P --state=CD,F,TO,OOM,CA -o JobID,User,UID,Account,Partition,State,End,ElapsedRaw,TotalCPU,CPUTimeRAW,MaxRSS,ReqMem,AllocTRES"
+	efficiencyTestData  = "test_data/sacct_efficiency.txt"
+	efficiencyStateFile = "job_efficiency.json"
+
+	gibibyte = 1024 * mebibyte
+	gigabyte = 1e9
+)
+
+var (
+	efficiencyLabels  = []string{"account", "user", "partition"}
+	efficiencyBuckets = prometheus.LinearBuckets(0.1, 0.1, 10)
+)
+
+// finishedJobUsage is what sacct reports about a finished job and its steps.
+type finishedJobUsage struct {
+	user      string
+	uid       string
+	account   string
+	partition string
+	end       time.Time
+	elapsed   float64
+	totalCPU  float64
+	cpuTime   float64
+	reqMemory float64
+	maxRSS    float64
+	hasSteps  bool
+}
+
+// parseSlurmDuration converts durations such as `1-02:03:04`, `02:03:04` or
+// `03:04.567` to seconds.
+func parseSlurmDuration(value string) (float64, bool) {
+	days := 0.0
+	if parts := strings.SplitN(value, "-", 2); len(parts) == 2 {
+		d, err := strconv.ParseFloat(parts[0], 64)
+		if err != nil {
+			return 0, false
+		}
+		days = d
+		value = parts[1]
+	}
+	seconds := 0.0
+	for _, part := range strings.Split(value, ":") {
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return 0, false
+		}
+		seconds = seconds*60 + v
+	}
+	return days*24*3600 + seconds, true
+}
+
+// parseReqMem converts the ReqMem sacct field to bytes. Older Slurm releases
+// suffix it with `c` or `n` when the memory was requested per CPU or per node.
+func parseReqMem(value string, alloc map[string]float64) (float64, bool) {
+	multiplier := 1.0
+	switch {
+	case strings.HasSuffix(value, "c"):
+		multiplier = alloc["cpu"]
+		value = strings.TrimSuffix(value, "c")
+	case strings.HasSuffix(value, "n"):
+		multiplier = alloc["node"]
+		value = strings.TrimSuffix(value, "n")
+	}
+	mem, ok := parseMemory(value, mebibyte)
+	return mem * multiplier, ok
+}
+
+// ParseJobUsage groups the lines printed by sacct for every job and its steps.
+func ParseJobUsage(out string) map[string]*finishedJobUsage {
+	jobs := make(map[string]*finishedJobUsage)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, "|")
+		if len(fields) < 13 {
+			continue
+		}
+		jobID := strings.SplitN(fields[0], ".", 2)[0]
+		job, ok := jobs[jobID]
+		if !ok {
+			job = &finishedJobUsage{}
+			jobs[jobID] = job
+		}
+		if jobID != fields[0] {
+			// Only steps know about the memory actually used
+			job.hasSteps = true
+			if rss, ok := parseMemory(fields[10], 1); ok {
+				job.maxRSS = math.Max(job.maxRSS, rss)
+			}
+			continue
+		}
+		job.user = fields[1]
+		job.uid = fields[2]
+		job.account = fields[3]
+		job.partition = fields[4]
+		job.end, _ = parseSacctTime(fields[6])
+		job.elapsed, _ = strconv.ParseFloat(fields[7], 64)
+		job.totalCPU, _ = parseSlurmDuration(fields[8])
+		job.cpuTime, _ = strconv.ParseFloat(fields[9], 64)
+		alloc := parseTRES(fields[12])
+		if mem, ok := alloc["mem"]; ok {
+			job.reqMemory = mem
+		} else {
+			job.reqMemory, _ = parseReqMem(fields[11], alloc)
+		}
+	}
+	return jobs
+}
+
+type efficiencyCollector struct {
+	cpuEfficiency    *prometheus.HistogramVec
+	memoryEfficiency *prometheus.HistogramVec
+	wastedCoreHours  *prometheus.CounterVec
+	wastedMemory     *prometheus.CounterVec
+	isTest           bool
+	ldap             *ldapsearch.Search
+	now              func() time.Time
+	mu               sync.Mutex
+	window           *sacctWindow
+}
+
+// NewEfficiencyCollector returns a collector computing the CPU and memory
+// efficiency of the jobs which finished since its previous scrape.
+func NewEfficiencyCollector(isTest bool, ldap *ldapsearch.Search, stateDir string) *efficiencyCollector {
+	path := ""
+	if stateDir != "" {
+		path = filepath.Join(stateDir, efficiencyStateFile)
+	}
+	return &efficiencyCollector{
+		isTest: isTest,
+		ldap:   ldap,
+		now:    time.Now,
+		window: loadSacctWindow(path),
+		cpuEfficiency: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Subsystem: "",
+				Name:      "slurm_job_cpu_efficiency",
+				Help:      "CPU time used by finished jobs over the CPU time allocated to them.",
+				Buckets:   efficiencyBuckets,
+			}, efficiencyLabels),
+		memoryEfficiency: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Subsystem: "",
+				Name:      "slurm_job_memory_efficiency",
+				Help:      "Maximum memory used by finished jobs over the memory allocated to them.",
+				Buckets:   efficiencyBuckets,
+			}, efficiencyLabels),
+		wastedCoreHours: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Subsystem: "",
+				Name:      "slurm_job_wasted_core_hours_total",
+				Help:      "Core hours allocated to finished jobs but not used.",
+			}, efficiencyLabels),
+		wastedMemory: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Subsystem: "",
+				Name:      "slurm_job_wasted_memory_gigabyte_hours_total",
+				Help:      "Memory allocated to finished jobs but not used, in gigabyte hours.",
+			}, efficiencyLabels),
+	}
+}
+
+func (s *efficiencyCollector) getEfficiencyMetrics(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	start, ok := s.window.start(now)
+	if !ok {
+		s.window.save()
+		return
+	}
+	var data string
+	if s.isTest {
+		data = readFile(efficiencyTestData)
+	} else {
+		data = execCommandArgs(ctx, efficiencyCommand, "-S", start.Format(sacctTimeFormat), "-E", now.Format(sacctTimeFormat))
+	}
+	for jobID, job := range ParseJobUsage(data) {
+		if job.end.IsZero() || job.end.Before(start) || job.cpuTime == 0 || !s.window.add(jobID, job.end) {
+			continue
+		}
+		user := job.user
+		if user == "" {
+			user = job.uid
+			if s.ldap != nil {
+				user = s.ldap.GetUsername(user)
+			}
+		}
+		labelValues := []string{job.account, user, job.partition}
+		s.cpuEfficiency.WithLabelValues(labelValues...).Observe(job.totalCPU / job.cpuTime)
+		s.wastedCoreHours.WithLabelValues(labelValues...).Add(math.Max(job.cpuTime-job.totalCPU, 0) / 3600)
+		if job.hasSteps && job.reqMemory > 0 {
+			s.memoryEfficiency.WithLabelValues(labelValues...).Observe(job.maxRSS / job.reqMemory)
+			wasted := math.Max(job.reqMemory-job.maxRSS, 0) / gigabyte
+			s.wastedMemory.WithLabelValues(labelValues...).Add(wasted * job.elapsed / 3600)
+		}
+	}
+	s.window.save()
+}
+
+func (s *efficiencyCollector) Describe(ch chan<- *prometheus.Desc) {
+	s.cpuEfficiency.Describe(ch)
+	s.memoryEfficiency.Describe(ch)
+	s.wastedCoreHours.Describe(ch)
+	s.wastedMemory.Describe(ch)
+}
+
+func (s *efficiencyCollector) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	s.getEfficiencyMetrics(ctx)
+	s.cpuEfficiency.Collect(ch)
+	s.memoryEfficiency.Collect(ch)
+	s.wastedCoreHours.Collect(ch)
+	s.wastedMemory.Collect(ch)
+}
@@ -0,0 +1,56 @@
+// SPDX-FileCopyrightText: 2022 2022 Marshall Wace <opensource@mwam.com>
+//
+// SPDX-License-Identifier: GPL3
+
+package slurm
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseJobUsage(t *testing.T) {
+	jobs := ParseJobUsage(readFile(efficiencyTestData))
+	assert.Len(t, jobs, 2)
+
+	job := jobs["4242"]
+	assert.Equal(t, "alice", job.user)
+	assert.Equal(t, 8*3600.0, job.totalCPU)
+	assert.Equal(t, 230400.0, job.cpuTime)
+	assert.Equal(t, 500.0*gibibyte, job.reqMemory)
+	assert.Equal(t, 10.0*gibibyte, job.maxRSS)
+
+	// ReqMem is per CPU
+	job = jobs["4243"]
+	assert.Equal(t, "1002", job.uid)
+	assert.Equal(t, 270.5, job.totalCPU)
+	assert.Equal(t, 1000.0*mebibyte, job.reqMemory)
+	assert.Equal(t, 900.0*mebibyte, job.maxRSS)
+}
+
+func TestParseSlurmDuration(t *testing.T) {
+	for value, expected := range map[string]float64{
+		"1-02:03:04": 93784,
+		"02:03:04":   7384,
+		"03:04.500":  184.5,
+	} {
+		seconds, ok := parseSlurmDuration(value)
+		assert.True(t, ok)
+		assert.Equal(t, expected, seconds)
+	}
+}
+
+func TestWastedMemory(t *testing.T) {
+	collector := NewEfficiencyCollector(true, nil, "")
+	now, _ := parseSacctTime("2022-10-01T10:15:00")
+	collector.now = func() time.Time { return now }
+	collector.window.Watermark = now.Add(-time.Hour).Unix()
+	collector.getEfficiencyMetrics(context.Background())
+	// 490 GiB over 1 hour, in decimal gigabytes
+	wasted := testutil.ToFloat64(collector.wastedMemory.WithLabelValues("physics", "alice", "compute"))
+	assert.InDelta(t, 490*1.073741824, wasted, 1e-9)
+}
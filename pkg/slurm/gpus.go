@@ -3,6 +3,7 @@
 package slurm
 
 import (
+	"context"
 	"strconv"
 	"strings"
 
@@ -16,14 +17,14 @@ type GPUsMetrics struct {
 	utilization float64
 }
 
-func GPUsGetMetrics() *GPUsMetrics {
-	return ParseGPUsMetrics()
+func GPUsGetMetrics(ctx context.Context) *GPUsMetrics {
+	return ParseGPUsMetrics(ctx)
 }
 
-func ParseAllocatedGPUs() float64 {
+func ParseAllocatedGPUs(ctx context.Context) float64 {
 	var num_gpus = 0.0
 
-	output := execCommand("sacct -a -X --format=AllocTRES --state=RUNNING --noheader --parsable2")
+	output := execCommand(ctx, "sacct -a -X --format=AllocTRES --state=RUNNING --noheader --parsable2")
 	if len(output) > 0 {
 		for _, line := range strings.Split(output, "\n") {
 			if len(line) > 0 {
@@ -42,24 +43,19 @@ func ParseAllocatedGPUs() float64 {
 	return num_gpus
 }
 
-func ParseTotalGPUs() float64 {
+func ParseTotalGPUs(ctx context.Context) float64 {
 	var num_gpus = 0.0
-	out := execCommand("sinfo -h -o \"%n %G\"")
+	out := execCommand(ctx, "sinfo -h -o \"%n %G\"")
 	if len(out) > 0 {
 		for _, line := range strings.Split(out, "\n") {
 			if len(line) > 0 {
 				line = strings.Trim(line, "\"")
-				gres := strings.Fields(line)[1]
-				// gres column format: comma-delimited list of resources
-				for _, resource := range strings.Split(gres, ",") {
-					if strings.HasPrefix(resource, "gpu:") {
-						// format: gpu:<type>:N(S:<something>), e.g. gpu:RTX2070:2(S:0)
-						descriptor := strings.Split(resource, ":")[2]
-						descriptor = strings.Split(descriptor, "(")[0]
-						node_gpus, _ := strconv.ParseFloat(descriptor, 64)
-						num_gpus += node_gpus
-					}
+				fields := strings.Fields(line)
+				if len(fields) < 2 {
+					continue
 				}
+				gres, _ := ParseGres(fields[1])
+				num_gpus += gresTotal(gresCounts(gres), "gpu")
 			}
 		}
 	}
@@ -67,10 +63,10 @@ func ParseTotalGPUs() float64 {
 	return num_gpus
 }
 
-func ParseGPUsMetrics() *GPUsMetrics {
+func ParseGPUsMetrics(ctx context.Context) *GPUsMetrics {
 	var gm GPUsMetrics
-	total_gpus := ParseTotalGPUs()
-	allocated_gpus := ParseAllocatedGPUs()
+	total_gpus := ParseTotalGPUs(ctx)
+	allocated_gpus := ParseAllocatedGPUs(ctx)
 	gm.alloc = allocated_gpus
 	gm.idle = total_gpus - allocated_gpus
 	gm.total = total_gpus
@@ -107,8 +103,8 @@ func (cc *GPUsCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- cc.total
 	ch <- cc.utilization
 }
-func (cc *GPUsCollector) Collect(ch chan<- prometheus.Metric) {
-	cm := GPUsGetMetrics()
+func (cc *GPUsCollector) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	cm := GPUsGetMetrics(ctx)
 	ch <- prometheus.MustNewConstMetric(cc.alloc, prometheus.GaugeValue, cm.alloc)
 	ch <- prometheus.MustNewConstMetric(cc.idle, prometheus.GaugeValue, cm.idle)
 	ch <- prometheus.MustNewConstMetric(cc.total, prometheus.GaugeValue, cm.total)
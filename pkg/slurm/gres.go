@@ -0,0 +1,174 @@
+// SPDX-FileCopyrightText: 2022 2022 Marshall Wace <opensource@mwam.com>
+//
+// SPDX-License-Identifier: GPL3
+
+package slurm
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Gres is an entry of the generic resources of a node, such as `gpu:a100:4`.
+type Gres struct {
+	name     string
+	gresType string
+	count    float64
+	// sockets the GRES are attached to, e.g. `0-1` for `(S:0-1)`
+	sockets string
+	// indexes of the GRES in use, e.g. `0-1` for `(IDX:0-1)` in gres_used
+	indexes string
+}
+
+// gresKey identifies the GRES of a node by name and type.
+type gresKey struct {
+	name     string
+	gresType string
+}
+
+// splitGres splits a GRES string on the commas which are not within
+// parentheses, as in `gpu:a100:2(IDX:0,2),nic:1`.
+func splitGres(gres string) []string {
+	var entries []string
+	depth, start := 0, 0
+	for i, c := range gres {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			if depth > 0 {
+				depth--
+			}
+		case ',':
+			if depth == 0 {
+				entries = append(entries, gres[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(entries, gres[start:])
+}
+
+// parseGresEntry parses `name[:type][:count][(S:sockets)|(IDX:indexes)]`. The
+// count defaults to 1, and may have a K, M, G, T or P multiplier. The type may
+// be a MIG profile such as `1g.10gb`.
+func parseGresEntry(entry string) (Gres, error) {
+	g := Gres{count: 1}
+	spec := entry
+	if open := strings.Index(entry, "("); open >= 0 {
+		spec = entry[:open]
+		details := strings.TrimSuffix(entry[open+1:], ")")
+		for _, detail := range strings.Split(details, "(") {
+			detail = strings.TrimSuffix(detail, ")")
+			switch {
+			case strings.HasPrefix(detail, "S:"):
+				g.sockets = strings.TrimPrefix(detail, "S:")
+			case strings.HasPrefix(detail, "IDX:"):
+				g.indexes = strings.TrimPrefix(detail, "IDX:")
+			}
+		}
+	}
+	fields := strings.Split(spec, ":")
+	g.name = fields[0]
+	if g.name == "" {
+		return g, fmt.Errorf("no GRES name in %q", entry)
+	}
+	switch len(fields) {
+	case 1:
+	case 2:
+		// `gpu:2` or `gpu:a100`
+		if count, ok := parseGresCount(fields[1]); ok {
+			g.count = count
+		} else {
+			g.gresType = fields[1]
+		}
+	case 3:
+		g.gresType = fields[1]
+		count, ok := parseGresCount(fields[2])
+		if !ok {
+			return g, fmt.Errorf("invalid GRES count in %q", entry)
+		}
+		g.count = count
+	default:
+		return g, fmt.Errorf("invalid GRES %q", entry)
+	}
+	return g, nil
+}
+
+func parseGresCount(value string) (float64, bool) {
+	count, ok := parseMemory(value, 1)
+	if !ok || count < 0 || math.IsNaN(count) || math.IsInf(count, 0) {
+		return 0, false
+	}
+	return count, true
+}
+
+// ParseGres parses the gres or gres_used fields of a node, such as
+// `gpu:a100:4(S:0-1),gpu:1g.10gb:2,shard:8`. Entries which cannot be parsed
+// are skipped, and reported in the returned error.
+func ParseGres(gres string) ([]Gres, error) {
+	gres = strings.TrimSpace(gres)
+	if gres == "" || gres == "(null)" || gres == "N/A" {
+		return nil, nil
+	}
+	var entries []Gres
+	var errs []string
+	for _, entry := range splitGres(gres) {
+		g, err := parseGresEntry(strings.TrimSpace(entry))
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		entries = append(entries, g)
+	}
+	if len(errs) > 0 {
+		return entries, fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+	return entries, nil
+}
+
+// gresCounts sums the GRES of a node by name and type.
+func gresCounts(entries []Gres) map[gresKey]float64 {
+	counts := make(map[gresKey]float64)
+	for _, g := range entries {
+		counts[gresKey{g.name, g.gresType}] += g.count
+	}
+	return counts
+}
+
+// gresUsage matches the GRES in use to the configured ones. Slurm reports
+// untyped GRES in use, such as `gpu:0`, for nodes whose GRES are typed: they
+// are accounted for under the only type of the GRES when there is a single
+// one. GRES in use which are not configured are left out.
+func gresUsage(total, used map[gresKey]float64) map[gresKey]float64 {
+	types := make(map[string][]gresKey)
+	for key := range total {
+		types[key.name] = append(types[key.name], key)
+	}
+	usage := make(map[gresKey]float64)
+	for key := range total {
+		usage[key] = 0
+	}
+	for key, count := range used {
+		if _, ok := total[key]; !ok {
+			if len(types[key.name]) != 1 {
+				continue
+			}
+			key = types[key.name][0]
+		}
+		usage[key] += count
+	}
+	return usage
+}
+
+// gresTotal returns the number of GRES called name, whatever their type.
+func gresTotal(counts map[gresKey]float64, name string) float64 {
+	total := 0.0
+	for key, count := range counts {
+		if key.name == name {
+			total += count
+		}
+	}
+	return total
+}
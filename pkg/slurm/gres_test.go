@@ -0,0 +1,153 @@
+// SPDX-FileCopyrightText: 2022 2022 Marshall Wace <opensource@mwam.com>
+//
+// SPDX-License-Identifier: GPL3
+
+package slurm
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseGres(t *testing.T) {
+	tests := []struct {
+		gres     string
+		expected []Gres
+	}{
+		{"", nil},
+		{"(null)", nil},
+		{"gpu:2", []Gres{{name: "gpu", count: 2}}},
+		{"gpu", []Gres{{name: "gpu", count: 1}}},
+		{"gpu:a100", []Gres{{name: "gpu", gresType: "a100", count: 1}}},
+		{"gpu:a100:4(S:0-1),gpu:v100:2", []Gres{
+			{name: "gpu", gresType: "a100", count: 4, sockets: "0-1"},
+			{name: "gpu", gresType: "v100", count: 2},
+		}},
+		{"gpu:a100:2(IDX:0,2),nic:0", []Gres{
+			{name: "gpu", gresType: "a100", count: 2, indexes: "0,2"},
+			{name: "nic", count: 0},
+		}},
+		{"gpu:1g.10gb:7(S:0)", []Gres{{name: "gpu", gresType: "1g.10gb", count: 7, sockets: "0"}}},
+		{"shard:a100:8,mps:1K", []Gres{
+			{name: "shard", gresType: "a100", count: 8},
+			{name: "mps", count: 1024},
+		}},
+		{"gpu:a100:0(IDX:N/A)", []Gres{{name: "gpu", gresType: "a100", count: 0, indexes: "N/A"}}},
+	}
+	for _, test := range tests {
+		gres, err := ParseGres(test.gres)
+		assert.NoError(t, err, test.gres)
+		assert.Equal(t, test.expected, gres, test.gres)
+	}
+
+	// Invalid entries are reported and skipped
+	gres, err := ParseGres("gpu:a100:x,nic:1,:2")
+	assert.Error(t, err)
+	assert.Equal(t, []Gres{{name: "nic", count: 1}}, gres)
+}
+
+func TestGresUsage(t *testing.T) {
+	total, _ := ParseGres("gpu:a100:4(S:0-1),nic:2")
+	used, _ := ParseGres("gpu:2(IDX:0-1),mps:100")
+	assert.Equal(t, map[gresKey]float64{
+		{"gpu", "a100"}: 2,
+		{"nic", ""}:     0,
+	}, gresUsage(gresCounts(total), gresCounts(used)))
+
+	// Untyped usage cannot be told apart between MIG profiles, it is only
+	// reported in the GPUs in use whatever their type
+	total, _ = ParseGres("gpu:1g.10gb:2,gpu:a100:2")
+	used, _ = ParseGres("gpu:1")
+	assert.Equal(t, map[gresKey]float64{
+		{"gpu", "1g.10gb"}: 0,
+		{"gpu", "a100"}:    0,
+	}, gresUsage(gresCounts(total), gresCounts(used)))
+	assert.Equal(t, 4.0, gresTotal(gresCounts(total), "gpu"))
+	assert.Equal(t, 1.0, gresTotal(gresCounts(used), "gpu"))
+}
+
+func FuzzParseGres(f *testing.F) {
+	for _, seed := range []string{
+		"gpu:a100:4(S:0-1),gpu:v100:2",
+		"gpu:a100:2(IDX:0,2),nic:0",
+		"gpu:1g.10gb:7(S:0)(IDX:0-6)",
+		"shard:8,mps:1K",
+		"gpu:a100:0(IDX:N/A)",
+		"(null)",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		gres, _ := ParseGres(s)
+		for _, g := range gres {
+			if g.name == "" || g.count < 0 {
+				t.Errorf("invalid GRES %+v parsed from %q", g, s)
+			}
+		}
+		counts := gresCounts(gres)
+		for key := range gresUsage(counts, counts) {
+			if _, ok := counts[key]; !ok {
+				t.Errorf("GRES %+v in use but not configured in %q", key, s)
+			}
+		}
+	})
+}
+
+func TestNodesGres(t *testing.T) {
+	collector := &scrapeCollector{ctx: context.Background(), collector: NewNodesCollector(true, "")}
+	expected := `
+# HELP slurm_node_gpu_free Number of free GPU on the node.
+# TYPE slurm_node_gpu_free gauge
+slurm_node_gpu_free{name="g001",partition="gpu"} 2
+slurm_node_gpu_free{name="g002",partition="gpu"} 4
+slurm_node_gpu_free{name="n001",partition="normal"} 0
+slurm_node_gpu_free{name="n002",partition="debug"} 0
+slurm_node_gpu_free{name="n002",partition="normal"} 0
+slurm_node_gpu_free{name="n003",partition="normal"} 0
+slurm_node_gpu_free{name="n004",partition="normal"} 0
+slurm_node_gpu_free{name="n005",partition="normal"} 0
+# HELP slurm_node_gres_total Number of generic resources on the node, by GRES name and type.
+# TYPE slurm_node_gres_total gauge
+slurm_node_gres_total{gres="gpu",name="g001",partition="gpu",type="a100"} 4
+slurm_node_gres_total{gres="gpu",name="g002",partition="gpu",type="1g.10gb"} 2
+slurm_node_gres_total{gres="gpu",name="g002",partition="gpu",type="a100"} 2
+slurm_node_gres_total{gres="nic",name="g001",partition="gpu",type=""} 2
+# HELP slurm_node_gres_used Number of generic resources in use on the node, by GRES name and type.
+# TYPE slurm_node_gres_used gauge
+slurm_node_gres_used{gres="gpu",name="g001",partition="gpu",type="a100"} 2
+slurm_node_gres_used{gres="gpu",name="g002",partition="gpu",type="1g.10gb"} 0
+slurm_node_gres_used{gres="gpu",name="g002",partition="gpu",type="a100"} 0
+slurm_node_gres_used{gres="nic",name="g001",partition="gpu",type=""} 0
+`
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(expected),
+		"slurm_node_gpu_free", "slurm_node_gres_total", "slurm_node_gres_used"))
+}
+
+func TestNodesGresUntypedUsage(t *testing.T) {
+	// A MIG node reporting its GPUs in use without type
+	ctx := withScrapeCache(context.Background())
+	cached(ctx, showNodesDetailsCommand, func() interface{} {
+		return &NodeDetails{Nodes: []NodeDetail{{
+			Name:       "g003",
+			Partitions: []string{"gpu"},
+			Gres:       "gpu:1g.10gb:2(S:0),gpu:a100:2(S:1)",
+			GresUsed:   "gpu:1(IDX:0)",
+		}}}
+	})
+	nc := NewNodesCollector(true, "")
+	collector := &scrapeCollector{ctx: ctx, collector: nc}
+	expected := `
+# HELP slurm_node_gpu_free Number of free GPU on the node.
+# TYPE slurm_node_gpu_free gauge
+slurm_node_gpu_free{name="g003",partition="gpu"} 3
+# HELP slurm_node_gpu_tot Number of total GPU on the node.
+# TYPE slurm_node_gpu_tot gauge
+slurm_node_gpu_tot{name="g003",partition="gpu"} 4
+`
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(expected),
+		"slurm_node_gpu_free", "slurm_node_gpu_tot"))
+}
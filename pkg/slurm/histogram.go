@@ -0,0 +1,44 @@
+// SPDX-FileCopyrightText: 2022 2022 Marshall Wace <opensource@mwam.com>
+//
+// SPDX-License-Identifier: GPL3
+
+package slurm
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// constHistogram accumulates the observations of a histogram computed from
+// scratch on every scrape, e.g. over the jobs currently pending.
+type constHistogram struct {
+	upperBounds []float64
+	count       uint64
+	sum         float64
+	buckets     map[float64]uint64
+}
+
+func newConstHistogram(upperBounds []float64) *constHistogram {
+	h := &constHistogram{
+		upperBounds: upperBounds,
+		buckets:     make(map[float64]uint64, len(upperBounds)),
+	}
+	// Empty buckets are reported too, so that every series has the same buckets
+	for _, upper := range upperBounds {
+		h.buckets[upper] = 0
+	}
+	return h
+}
+
+func (h *constHistogram) observe(value float64) {
+	h.count++
+	h.sum += value
+	for _, upper := range h.upperBounds {
+		if value <= upper {
+			h.buckets[upper]++
+		}
+	}
+}
+
+func (h *constHistogram) metric(desc *prometheus.Desc, labelValues ...string) prometheus.Metric {
+	return prometheus.MustNewConstHistogram(desc, h.count, h.sum, h.buckets, labelValues...)
+}
@@ -5,9 +5,11 @@
 package slurm
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"strconv"
+	"strings"
 
 	"github.com/MarshallWace/slurm-exporter/pkg/ldapsearch"
 	"github.com/prometheus/client_golang/prometheus"
@@ -23,8 +25,15 @@ const (
 	numberOfHistogramBuckets = 15
 )
 
+// How array jobs are reported, one series per task, per array or both.
+const (
+	JobArraysTasks     = "tasks"
+	JobArraysAggregate = "aggregate"
+	JobArraysBoth      = "both"
+)
+
 var (
-	jobLabels       = []string{"name", "job_id", "state", "state_reason", "partition", "user", "node"}
+	jobLabels       = []string{"name", "job_id", "state", "state_reason", "partition", "qos", "user", "node", "het_component"}
 	durationBuckets = prometheus.ExponentialBucketsRange(minHistogramBucketRange, maxHistogramBucketRange, numberOfHistogramBuckets)
 )
 
@@ -39,12 +48,23 @@ type jobsCollector struct {
 	jobSchedlingDuration *prometheus.HistogramVec
 	isTest               bool
 	ldap                 *ldapsearch.Search
+
+	// Array jobs, see JobArraysTasks and siblings
+	arrayMode      string
+	arrayTasks     *prometheus.Desc
+	arrayReqCPU    *prometheus.Desc
+	arrayReqMemory *prometheus.Desc
 }
 
-func NewJobsCollector(isTest bool, ldap *ldapsearch.Search) *jobsCollector {
+func NewJobsCollector(isTest bool, ldap *ldapsearch.Search, arrayMode string) *jobsCollector {
+	arrayLabels := []string{"array_job_id", "user", "partition"}
 	return &jobsCollector{
-		isTest: isTest,
-		ldap:   ldap,
+		isTest:         isTest,
+		ldap:           ldap,
+		arrayMode:      arrayMode,
+		arrayTasks:     prometheus.NewDesc("slurm_job_array_tasks", "Tasks of the array job by state: pending, running, completed or failed", append(arrayLabels, "state"), nil),
+		arrayReqCPU:    prometheus.NewDesc("slurm_job_array_req_cpu", "Requested CPU by the tasks of the array job still in the queue", arrayLabels, nil),
+		arrayReqMemory: prometheus.NewDesc("slurm_job_array_req_memory_bytes", "Requested Memory by the tasks of the array job still in the queue", arrayLabels, nil),
 		jobsInfo: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Subsystem: "",
@@ -98,31 +118,43 @@ func NewJobsCollector(isTest bool, ldap *ldapsearch.Search) *jobsCollector {
 	}
 }
 
-func (s *jobsCollector) getJobsMetrics() {
-	// Get json data
-	data := getData(s.isTest, showJobsCommand, showJobsTestDataInput)
+// getJobs returns the jobs listed by squeue. They are fetched and parsed once
+// per scrape, however many collectors need them.
+func getJobs(ctx context.Context, isTest bool) *SqueuOutput {
+	return cached(ctx, showJobsCommand, func() interface{} {
+		// Get json data
+		data := getData(ctx, isTest, showJobsCommand, showJobsTestDataInput)
 
-	// Parse json
-	squeueJson := &SqueuOutput{}
-	err := json.Unmarshal([]byte(data), squeueJson)
-	if err != nil {
-		ExporterErrors.WithLabelValues("json-encoding-sqeueu", err.Error()).Inc()
-		fmt.Println(err)
-	}
+		// Parse json
+		squeueJson := &SqueuOutput{}
+		err := json.Unmarshal([]byte(data), squeueJson)
+		if err != nil {
+			ExporterErrors.WithLabelValues("json-encoding-sqeueu", err.Error()).Inc()
+			fmt.Println(err)
+		}
+		return squeueJson
+	}).(*SqueuOutput)
+}
+
+func (s *jobsCollector) getJobsMetrics(ctx context.Context) {
+	squeueJson := getJobs(ctx, s.isTest)
 	// create metrics from json object
 	for _, job := range squeueJson.Jobs {
-		user := job.UserName
-		if user == "" {
-			user = strconv.Itoa(job.UserID)
-			if s.ldap != nil {
-				user = s.ldap.GetUsername(user)
-			}
+		if job.ArrayJobID != 0 && s.arrayMode == JobArraysAggregate {
+			continue
 		}
-		labelValues := []string{job.Name, strconv.Itoa(job.JobID), job.JobState, job.StateReason, job.Partition, user, job.Nodes}
+		user := s.userName(job)
+		// The components of a heterogeneous job are reported under the ID of
+		// the job, which is the one of its first component
+		jobID, hetComponent := strconv.Itoa(job.JobID), ""
+		if job.HetJobID != 0 {
+			jobID, hetComponent = strconv.Itoa(job.HetJobID), strconv.Itoa(job.HetJobOffset)
+		}
+		labelValues := []string{job.Name, jobID, job.JobState, job.StateReason, job.Partition, job.Qos, user, job.Nodes, hetComponent}
 		s.jobsInfo.WithLabelValues(labelValues...).Set(1)
 		s.jobsRestartCount.WithLabelValues(labelValues...).Set(float64(job.RestartCnt))
 		s.jobsReqCPU.WithLabelValues(labelValues...).Set(float64(job.Cpus))
-		s.jobsReqMemory.WithLabelValues(labelValues...).Set(float64(job.MemoryPerCPU * job.Cpus))
+		s.jobsReqMemory.WithLabelValues(labelValues...).Set(jobReqMemory(job))
 		s.jobsReqNodes.WithLabelValues(labelValues...).Set(float64(job.NodeCount))
 		s.jobsReqBilling.WithLabelValues(labelValues...).Set(job.BillableTres)
 		if job.StartTime != 0 {
@@ -136,6 +168,118 @@ func (s *jobsCollector) getJobsMetrics() {
 	}
 }
 
+func (s *jobsCollector) userName(job SqueueJob) string {
+	if job.UserName != "" {
+		return job.UserName
+	}
+	user := strconv.Itoa(job.UserID)
+	if s.ldap != nil {
+		user = s.ldap.GetUsername(user)
+	}
+	return user
+}
+
+// jobReqMemory returns the memory requested by job in bytes, whether it was
+// requested per CPU or per node (--mem).
+func jobReqMemory(job SqueueJob) float64 {
+	if mem, ok := parseTRES(job.TresReqStr)["mem"]; ok {
+		return mem
+	}
+	if perNode, ok := job.MemoryPerNode.(float64); ok {
+		return perNode * float64(job.NodeCount) * mebibyte
+	}
+	return float64(job.MemoryPerCPU*job.Cpus) * mebibyte
+}
+
+// countArrayTasks returns the number of tasks of an array_task_string such as
+// `3-10%2` or `1,5-9:2`, the tasks of an array job which are still pending.
+func countArrayTasks(tasks string) int {
+	tasks = strings.SplitN(tasks, "%", 2)[0]
+	count := 0
+	for _, r := range strings.Split(tasks, ",") {
+		step := 1
+		if i := strings.Index(r, ":"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(r[i+1:])
+			if err != nil || step < 1 {
+				continue
+			}
+			r = r[:i]
+		}
+		bounds := strings.SplitN(r, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			continue
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, err = strconv.Atoi(bounds[1])
+			if err != nil || last < first {
+				continue
+			}
+		}
+		count += (last-first)/step + 1
+	}
+	return count
+}
+
+// jobArray aggregates the tasks of an array job.
+type jobArray struct {
+	user      string
+	partition string
+	tasks     map[string]float64
+	reqCPU    float64
+	reqMemory float64
+}
+
+// arrayTaskState maps the state of a task to the ones of slurm_job_array_tasks.
+func arrayTaskState(state string) string {
+	switch state {
+	case "PENDING", "REQUEUED":
+		return "pending"
+	case "RUNNING", "CONFIGURING", "COMPLETING", "SUSPENDED":
+		return "running"
+	case "COMPLETED":
+		return "completed"
+	case "FAILED", "TIMEOUT", "NODE_FAIL", "OUT_OF_MEMORY", "BOOT_FAIL", "DEADLINE":
+		return "failed"
+	}
+	return ""
+}
+
+func (s *jobsCollector) getJobArrays(ctx context.Context) map[int]*jobArray {
+	arrays := make(map[int]*jobArray)
+	for _, job := range getJobs(ctx, s.isTest).Jobs {
+		if job.ArrayJobID == 0 {
+			continue
+		}
+		array, ok := arrays[job.ArrayJobID]
+		if !ok {
+			array = &jobArray{
+				user:      s.userName(job),
+				partition: job.Partition,
+				tasks:     map[string]float64{"pending": 0, "running": 0, "completed": 0, "failed": 0},
+			}
+			arrays[job.ArrayJobID] = array
+		}
+		// The tasks which did not start yet are listed together
+		tasks := 1.0
+		if job.ArrayTaskString != "" {
+			tasks = float64(countArrayTasks(job.ArrayTaskString))
+		}
+		state := arrayTaskState(job.JobState)
+		if state == "" {
+			continue
+		}
+		array.tasks[state] += tasks
+		if state == "pending" || state == "running" {
+			array.reqCPU += tasks * float64(job.Cpus)
+			array.reqMemory += tasks * jobReqMemory(job)
+		}
+	}
+	return arrays
+}
+
 func (s *jobsCollector) Describe(ch chan<- *prometheus.Desc) {
 	s.jobsInfo.Describe(ch)
 	s.jobExecDuration.Describe(ch)
@@ -145,9 +289,14 @@ func (s *jobsCollector) Describe(ch chan<- *prometheus.Desc) {
 	s.jobsReqBilling.Describe(ch)
 	s.jobsReqNodes.Describe(ch)
 	s.jobsRestartCount.Describe(ch)
+	if s.arrayMode != JobArraysTasks {
+		ch <- s.arrayTasks
+		ch <- s.arrayReqCPU
+		ch <- s.arrayReqMemory
+	}
 }
 
-func (s *jobsCollector) Collect(ch chan<- prometheus.Metric) {
+func (s *jobsCollector) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) {
 	s.jobsInfo.Reset()
 	s.jobExecDuration.Reset()
 	s.jobSchedlingDuration.Reset()
@@ -156,7 +305,7 @@ func (s *jobsCollector) Collect(ch chan<- prometheus.Metric) {
 	s.jobsReqBilling.Reset()
 	s.jobsReqNodes.Reset()
 	s.jobsRestartCount.Reset()
-	s.getJobsMetrics()
+	s.getJobsMetrics(ctx)
 	s.jobsInfo.Collect(ch)
 	s.jobExecDuration.Collect(ch)
 	s.jobSchedlingDuration.Collect(ch)
@@ -165,6 +314,16 @@ func (s *jobsCollector) Collect(ch chan<- prometheus.Metric) {
 	s.jobsReqBilling.Collect(ch)
 	s.jobsReqNodes.Collect(ch)
 	s.jobsRestartCount.Collect(ch)
+	if s.arrayMode != JobArraysTasks {
+		for id, array := range s.getJobArrays(ctx) {
+			arrayJobID := strconv.Itoa(id)
+			for state, tasks := range array.tasks {
+				ch <- prometheus.MustNewConstMetric(s.arrayTasks, prometheus.GaugeValue, tasks, arrayJobID, array.user, array.partition, state)
+			}
+			ch <- prometheus.MustNewConstMetric(s.arrayReqCPU, prometheus.GaugeValue, array.reqCPU, arrayJobID, array.user, array.partition)
+			ch <- prometheus.MustNewConstMetric(s.arrayReqMemory, prometheus.GaugeValue, array.reqMemory, arrayJobID, array.user, array.partition)
+		}
+	}
 }
 
 type SqueuOutput struct {
@@ -183,115 +342,117 @@ type SqueuOutput struct {
 		} `json:"Slurm"`
 	} `json:"meta"`
 	Errors []interface{} `json:"errors"`
-	Jobs   []struct {
-		Account                  string        `json:"account"`
-		AccrueTime               int           `json:"accrue_time"`
-		AdminComment             string        `json:"admin_comment"`
-		ArrayJobID               int           `json:"array_job_id"`
-		ArrayTaskID              interface{}   `json:"array_task_id"`
-		ArrayMaxTasks            int           `json:"array_max_tasks"`
-		ArrayTaskString          string        `json:"array_task_string"`
-		AssociationID            int           `json:"association_id"`
-		BatchFeatures            string        `json:"batch_features"`
-		BatchFlag                bool          `json:"batch_flag"`
-		BatchHost                string        `json:"batch_host"`
-		Flags                    []string      `json:"flags"`
-		BurstBuffer              string        `json:"burst_buffer"`
-		BurstBufferState         string        `json:"burst_buffer_state"`
-		Cluster                  string        `json:"cluster"`
-		ClusterFeatures          string        `json:"cluster_features"`
-		Command                  string        `json:"command"`
-		Comment                  string        `json:"comment"`
-		Contiguous               bool          `json:"contiguous"`
-		CoreSpec                 interface{}   `json:"core_spec"`
-		ThreadSpec               interface{}   `json:"thread_spec"`
-		CoresPerSocket           interface{}   `json:"cores_per_socket"`
-		BillableTres             float64       `json:"billable_tres"`
-		CpusPerTask              interface{}   `json:"cpus_per_task"`
-		CPUFrequencyMinimum      interface{}   `json:"cpu_frequency_minimum"`
-		CPUFrequencyMaximum      interface{}   `json:"cpu_frequency_maximum"`
-		CPUFrequencyGovernor     interface{}   `json:"cpu_frequency_governor"`
-		CpusPerTres              string        `json:"cpus_per_tres"`
-		Deadline                 int           `json:"deadline"`
-		DelayBoot                int           `json:"delay_boot"`
-		Dependency               string        `json:"dependency"`
-		DerivedExitCode          int           `json:"derived_exit_code"`
-		EligibleTime             int           `json:"eligible_time"`
-		EndTime                  int           `json:"end_time"`
-		ExcludedNodes            string        `json:"excluded_nodes"`
-		ExitCode                 int           `json:"exit_code"`
-		Features                 string        `json:"features"`
-		FederationOrigin         string        `json:"federation_origin"`
-		FederationSiblingsActive string        `json:"federation_siblings_active"`
-		FederationSiblingsViable string        `json:"federation_siblings_viable"`
-		GresDetail               []interface{} `json:"gres_detail"`
-		GroupID                  int           `json:"group_id"`
-		JobID                    int           `json:"job_id"`
-		JobResources             struct {
-		} `json:"job_resources"`
-		JobState                string      `json:"job_state"`
-		LastSchedEvaluation     int         `json:"last_sched_evaluation"`
-		Licenses                string      `json:"licenses"`
-		MaxCpus                 int         `json:"max_cpus"`
-		MaxNodes                int         `json:"max_nodes"`
-		McsLabel                string      `json:"mcs_label"`
-		MemoryPerTres           string      `json:"memory_per_tres"`
-		Name                    string      `json:"name"`
-		Nodes                   string      `json:"nodes"`
-		Nice                    int         `json:"nice"`
-		TasksPerCore            interface{} `json:"tasks_per_core"`
-		TasksPerNode            int         `json:"tasks_per_node"`
-		TasksPerSocket          interface{} `json:"tasks_per_socket"`
-		TasksPerBoard           int         `json:"tasks_per_board"`
-		Cpus                    int         `json:"cpus"`
-		NodeCount               int         `json:"node_count"`
-		Tasks                   int         `json:"tasks"`
-		HetJobID                int         `json:"het_job_id"`
-		HetJobIDSet             string      `json:"het_job_id_set"`
-		HetJobOffset            int         `json:"het_job_offset"`
-		Partition               string      `json:"partition"`
-		MemoryPerNode           interface{} `json:"memory_per_node"`
-		MemoryPerCPU            int         `json:"memory_per_cpu"`
-		MinimumCpusPerNode      int         `json:"minimum_cpus_per_node"`
-		MinimumTmpDiskPerNode   int         `json:"minimum_tmp_disk_per_node"`
-		PreemptTime             int         `json:"preempt_time"`
-		PreSusTime              int         `json:"pre_sus_time"`
-		Priority                int         `json:"priority"`
-		Profile                 interface{} `json:"profile"`
-		Qos                     string      `json:"qos"`
-		Reboot                  bool        `json:"reboot"`
-		RequiredNodes           string      `json:"required_nodes"`
-		Requeue                 bool        `json:"requeue"`
-		ResizeTime              int         `json:"resize_time"`
-		RestartCnt              int         `json:"restart_cnt"`
-		ResvName                string      `json:"resv_name"`
-		Shared                  string      `json:"shared"`
-		ShowFlags               []string    `json:"show_flags"`
-		SocketsPerBoard         int         `json:"sockets_per_board"`
-		SocketsPerNode          interface{} `json:"sockets_per_node"`
-		StartTime               int         `json:"start_time"`
-		StateDescription        string      `json:"state_description"`
-		StateReason             string      `json:"state_reason"`
-		StandardError           string      `json:"standard_error"`
-		StandardInput           string      `json:"standard_input"`
-		StandardOutput          string      `json:"standard_output"`
-		SubmitTime              int         `json:"submit_time"`
-		SuspendTime             int         `json:"suspend_time"`
-		SystemComment           string      `json:"system_comment"`
-		TimeLimit               int         `json:"time_limit"`
-		TimeMinimum             int         `json:"time_minimum"`
-		ThreadsPerCore          interface{} `json:"threads_per_core"`
-		TresBind                string      `json:"tres_bind"`
-		TresFreq                string      `json:"tres_freq"`
-		TresPerJob              string      `json:"tres_per_job"`
-		TresPerNode             string      `json:"tres_per_node"`
-		TresPerSocket           string      `json:"tres_per_socket"`
-		TresPerTask             string      `json:"tres_per_task"`
-		TresReqStr              string      `json:"tres_req_str"`
-		TresAllocStr            string      `json:"tres_alloc_str"`
-		UserID                  int         `json:"user_id"`
-		UserName                string      `json:"user_name"`
-		Wckey                   string      `json:"wckey"`
-		CurrentWorkingDirectory string      `json:"current_working_directory"`
-	} `json:"jobs"`
+	Jobs   []SqueueJob   `json:"jobs"`
+}
+
+type SqueueJob struct {
+	Account                  string        `json:"account"`
+	AccrueTime               int           `json:"accrue_time"`
+	AdminComment             string        `json:"admin_comment"`
+	ArrayJobID               int           `json:"array_job_id"`
+	ArrayTaskID              interface{}   `json:"array_task_id"`
+	ArrayMaxTasks            int           `json:"array_max_tasks"`
+	ArrayTaskString          string        `json:"array_task_string"`
+	AssociationID            int           `json:"association_id"`
+	BatchFeatures            string        `json:"batch_features"`
+	BatchFlag                bool          `json:"batch_flag"`
+	BatchHost                string        `json:"batch_host"`
+	Flags                    []string      `json:"flags"`
+	BurstBuffer              string        `json:"burst_buffer"`
+	BurstBufferState         string        `json:"burst_buffer_state"`
+	Cluster                  string        `json:"cluster"`
+	ClusterFeatures          string        `json:"cluster_features"`
+	Command                  string        `json:"command"`
+	Comment                  string        `json:"comment"`
+	Contiguous               bool          `json:"contiguous"`
+	CoreSpec                 interface{}   `json:"core_spec"`
+	ThreadSpec               interface{}   `json:"thread_spec"`
+	CoresPerSocket           interface{}   `json:"cores_per_socket"`
+	BillableTres             float64       `json:"billable_tres"`
+	CpusPerTask              interface{}   `json:"cpus_per_task"`
+	CPUFrequencyMinimum      interface{}   `json:"cpu_frequency_minimum"`
+	CPUFrequencyMaximum      interface{}   `json:"cpu_frequency_maximum"`
+	CPUFrequencyGovernor     interface{}   `json:"cpu_frequency_governor"`
+	CpusPerTres              string        `json:"cpus_per_tres"`
+	Deadline                 int           `json:"deadline"`
+	DelayBoot                int           `json:"delay_boot"`
+	Dependency               string        `json:"dependency"`
+	DerivedExitCode          int           `json:"derived_exit_code"`
+	EligibleTime             int           `json:"eligible_time"`
+	EndTime                  int           `json:"end_time"`
+	ExcludedNodes            string        `json:"excluded_nodes"`
+	ExitCode                 int           `json:"exit_code"`
+	Features                 string        `json:"features"`
+	FederationOrigin         string        `json:"federation_origin"`
+	FederationSiblingsActive string        `json:"federation_siblings_active"`
+	FederationSiblingsViable string        `json:"federation_siblings_viable"`
+	GresDetail               []interface{} `json:"gres_detail"`
+	GroupID                  int           `json:"group_id"`
+	JobID                    int           `json:"job_id"`
+	JobResources             struct {
+	} `json:"job_resources"`
+	JobState                string      `json:"job_state"`
+	LastSchedEvaluation     int         `json:"last_sched_evaluation"`
+	Licenses                string      `json:"licenses"`
+	MaxCpus                 int         `json:"max_cpus"`
+	MaxNodes                int         `json:"max_nodes"`
+	McsLabel                string      `json:"mcs_label"`
+	MemoryPerTres           string      `json:"memory_per_tres"`
+	Name                    string      `json:"name"`
+	Nodes                   string      `json:"nodes"`
+	Nice                    int         `json:"nice"`
+	TasksPerCore            interface{} `json:"tasks_per_core"`
+	TasksPerNode            int         `json:"tasks_per_node"`
+	TasksPerSocket          interface{} `json:"tasks_per_socket"`
+	TasksPerBoard           int         `json:"tasks_per_board"`
+	Cpus                    int         `json:"cpus"`
+	NodeCount               int         `json:"node_count"`
+	Tasks                   int         `json:"tasks"`
+	HetJobID                int         `json:"het_job_id"`
+	HetJobIDSet             string      `json:"het_job_id_set"`
+	HetJobOffset            int         `json:"het_job_offset"`
+	Partition               string      `json:"partition"`
+	MemoryPerNode           interface{} `json:"memory_per_node"`
+	MemoryPerCPU            int         `json:"memory_per_cpu"`
+	MinimumCpusPerNode      int         `json:"minimum_cpus_per_node"`
+	MinimumTmpDiskPerNode   int         `json:"minimum_tmp_disk_per_node"`
+	PreemptTime             int         `json:"preempt_time"`
+	PreSusTime              int         `json:"pre_sus_time"`
+	Priority                int         `json:"priority"`
+	Profile                 interface{} `json:"profile"`
+	Qos                     string      `json:"qos"`
+	Reboot                  bool        `json:"reboot"`
+	RequiredNodes           string      `json:"required_nodes"`
+	Requeue                 bool        `json:"requeue"`
+	ResizeTime              int         `json:"resize_time"`
+	RestartCnt              int         `json:"restart_cnt"`
+	ResvName                string      `json:"resv_name"`
+	Shared                  string      `json:"shared"`
+	ShowFlags               []string    `json:"show_flags"`
+	SocketsPerBoard         int         `json:"sockets_per_board"`
+	SocketsPerNode          interface{} `json:"sockets_per_node"`
+	StartTime               int         `json:"start_time"`
+	StateDescription        string      `json:"state_description"`
+	StateReason             string      `json:"state_reason"`
+	StandardError           string      `json:"standard_error"`
+	StandardInput           string      `json:"standard_input"`
+	StandardOutput          string      `json:"standard_output"`
+	SubmitTime              int         `json:"submit_time"`
+	SuspendTime             int         `json:"suspend_time"`
+	SystemComment           string      `json:"system_comment"`
+	TimeLimit               int         `json:"time_limit"`
+	TimeMinimum             int         `json:"time_minimum"`
+	ThreadsPerCore          interface{} `json:"threads_per_core"`
+	TresBind                string      `json:"tres_bind"`
+	TresFreq                string      `json:"tres_freq"`
+	TresPerJob              string      `json:"tres_per_job"`
+	TresPerNode             string      `json:"tres_per_node"`
+	TresPerSocket           string      `json:"tres_per_socket"`
+	TresPerTask             string      `json:"tres_per_task"`
+	TresReqStr              string      `json:"tres_req_str"`
+	TresAllocStr            string      `json:"tres_alloc_str"`
+	UserID                  int         `json:"user_id"`
+	UserName                string      `json:"user_name"`
+	Wckey                   string      `json:"wckey"`
+	CurrentWorkingDirectory string      `json:"current_working_directory"`
 }
@@ -4,6 +4,14 @@
 
 package slurm
 
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
 // import (
 // 	"os"
 // 	"testing"
@@ -31,3 +39,47 @@ package slurm
 // 	err = prometheus.WriteToTextfile(showJobsTestDataProm, gatherers)
 // 	assert.NoError(t, err)
 // }
+
+func TestCountArrayTasks(t *testing.T) {
+	assert.Equal(t, 8, countArrayTasks("3-10%2"))
+	assert.Equal(t, 4, countArrayTasks("1,5-9:2"))
+	assert.Equal(t, 1, countArrayTasks("7"))
+	assert.Equal(t, 0, countArrayTasks("N/A"))
+}
+
+func TestJobArrays(t *testing.T) {
+	collector := NewJobsCollector(true, nil, JobArraysAggregate)
+	arrays := collector.getJobArrays(context.Background())
+	assert.Len(t, arrays, 1)
+	array := arrays[1010]
+	assert.Equal(t, map[string]float64{"pending": 8, "running": 1, "completed": 1, "failed": 0}, array.tasks)
+	assert.Equal(t, 9.0, array.reqCPU)
+	assert.Equal(t, float64(9*1024*mebibyte), array.reqMemory)
+
+	// The 3 records of the array are left out of the per job series
+	ctx := context.Background()
+	tasks := testutil.CollectAndCount(&scrapeCollector{ctx: ctx, collector: NewJobsCollector(true, nil, JobArraysTasks)}, "slurm_job_info")
+	aggregate := testutil.CollectAndCount(&scrapeCollector{ctx: ctx, collector: collector}, "slurm_job_info")
+	assert.Equal(t, tasks-3, aggregate)
+	assert.Equal(t, 4, testutil.CollectAndCount(&scrapeCollector{ctx: ctx, collector: collector}, "slurm_job_array_tasks"))
+	assert.Equal(t, 0, testutil.CollectAndCount(&scrapeCollector{ctx: ctx, collector: NewJobsCollector(true, nil, JobArraysTasks)}, "slurm_job_array_tasks"))
+
+	// Each task requests 1024M
+	tasksCollector := NewJobsCollector(true, nil, JobArraysTasks)
+	tasksCollector.getJobsMetrics(ctx)
+	assert.Equal(t, float64(1024*mebibyte), testutil.ToFloat64(tasksCollector.jobsReqMemory.WithLabelValues("job1012", "1012", "RUNNING", "None", "compute", "normal", "dave", "n002", "")))
+}
+
+func TestJobReqMemory(t *testing.T) {
+	assert.Equal(t, float64(32*1024*mebibyte), jobReqMemory(SqueueJob{TresReqStr: "cpu=8,mem=32G,node=1"}))
+	// --mem of 2 nodes
+	assert.Equal(t, float64(8*1024*mebibyte), jobReqMemory(SqueueJob{MemoryPerNode: 4096.0, NodeCount: 2}))
+	assert.Equal(t, float64(4*1024*mebibyte), jobReqMemory(SqueueJob{MemoryPerCPU: 1024, Cpus: 4, MemoryPerNode: "None"}))
+}
+
+func TestHetJobLabels(t *testing.T) {
+	collector := NewJobsCollector(true, nil, JobArraysTasks)
+	collector.getJobsMetrics(context.Background())
+	assert.Equal(t, 2.0, testutil.ToFloat64(collector.jobsReqCPU.WithLabelValues("job1020", "1020", "RUNNING", "None", "compute", "normal", "erin", "n003", "0")))
+	assert.Equal(t, 4.0, testutil.ToFloat64(collector.jobsReqCPU.WithLabelValues("job1021", "1020", "RUNNING", "None", "gpu", "normal", "erin", "g001", "1")))
+}
@@ -0,0 +1,136 @@
+// SPDX-FileCopyrightText: 2022 2022 Marshall Wace <opensource@mwam.com>
+//
+// SPDX-License-Identifier: GPL3
+
+package slurm
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	licensesCommand  = "scontrol show licenses"
+	licensesTestData = "test_data/licenses.txt"
+)
+
+type LicenseMetrics struct {
+	total       float64
+	used        float64
+	free        float64
+	reserved    float64
+	pending     float64
+	pendingLics float64
+}
+
+// parseJobLicenses returns the names of the licenses requested by a job, e.g.
+// `matlab:2,ansys@flex` or `matlab|ansys` when any of them would do.
+func parseJobLicenses(licenses string) []string {
+	var names []string
+	for _, license := range strings.FieldsFunc(licenses, func(r rune) bool { return r == ',' || r == '|' }) {
+		names = append(names, strings.SplitN(license, ":", 2)[0])
+	}
+	return names
+}
+
+func (lc *LicensesCollector) LicensesGetMetrics(ctx context.Context) map[string]*LicenseMetrics {
+	licenses := make(map[string]*LicenseMetrics)
+	out := getData(ctx, lc.isTest, licensesCommand, licensesTestData)
+	// Every license starts with LicenseName=, its counters follow on the
+	// same line or on the next one depending on the Slurm release
+	var lm *LicenseMetrics
+	for _, field := range strings.Fields(out) {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		if kv[0] == "LicenseName" {
+			lm = &LicenseMetrics{}
+			licenses[kv[1]] = lm
+			continue
+		}
+		if lm == nil {
+			continue
+		}
+		value, _ := strconv.ParseFloat(kv[1], 64)
+		switch kv[0] {
+		case "Total":
+			lm.total = value
+		case "Used":
+			lm.used = value
+		case "Free":
+			lm.free = value
+		case "Reserved":
+			lm.reserved = value
+		}
+	}
+	for _, job := range getJobs(ctx, lc.isTest).Jobs {
+		if job.JobState != "PENDING" || job.Licenses == "" {
+			continue
+		}
+		for _, name := range parseJobLicenses(job.Licenses) {
+			lm, ok := licenses[name]
+			if !ok {
+				continue
+			}
+			lm.pending++
+			if job.StateReason == "Licenses" {
+				lm.pendingLics++
+			}
+		}
+	}
+	return licenses
+}
+
+/*
+ * Implement the Prometheus Collector interface and feed the
+ * Slurm licenses into it.
+ * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
+ */
+
+type LicensesCollector struct {
+	isTest      bool
+	total       *prometheus.Desc
+	used        *prometheus.Desc
+	free        *prometheus.Desc
+	reserved    *prometheus.Desc
+	pending     *prometheus.Desc
+	pendingLics *prometheus.Desc
+}
+
+func NewLicensesCollector(isTest bool) *LicensesCollector {
+	labels := []string{"license"}
+	return &LicensesCollector{
+		isTest:      isTest,
+		total:       prometheus.NewDesc("slurm_license_total", "Total licenses", labels, nil),
+		used:        prometheus.NewDesc("slurm_license_used", "Licenses used by jobs", labels, nil),
+		free:        prometheus.NewDesc("slurm_license_free", "Licenses available to jobs", labels, nil),
+		reserved:    prometheus.NewDesc("slurm_license_reserved", "Licenses held by reservations", labels, nil),
+		pending:     prometheus.NewDesc("slurm_license_jobs_pending", "Pending jobs requesting the license", labels, nil),
+		pendingLics: prometheus.NewDesc("slurm_license_jobs_pending_licenses", "Pending jobs requesting the license and waiting for licenses to become available", labels, nil),
+	}
+}
+
+func (lc *LicensesCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- lc.total
+	ch <- lc.used
+	ch <- lc.free
+	ch <- lc.reserved
+	ch <- lc.pending
+	ch <- lc.pendingLics
+}
+
+func (lc *LicensesCollector) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	lm := lc.LicensesGetMetrics(ctx)
+	for l := range lm {
+		ch <- prometheus.MustNewConstMetric(lc.total, prometheus.GaugeValue, lm[l].total, l)
+		ch <- prometheus.MustNewConstMetric(lc.used, prometheus.GaugeValue, lm[l].used, l)
+		ch <- prometheus.MustNewConstMetric(lc.free, prometheus.GaugeValue, lm[l].free, l)
+		ch <- prometheus.MustNewConstMetric(lc.reserved, prometheus.GaugeValue, lm[l].reserved, l)
+		ch <- prometheus.MustNewConstMetric(lc.pending, prometheus.GaugeValue, lm[l].pending, l)
+		ch <- prometheus.MustNewConstMetric(lc.pendingLics, prometheus.GaugeValue, lm[l].pendingLics, l)
+	}
+}
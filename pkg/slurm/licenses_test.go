@@ -0,0 +1,21 @@
+// SPDX-FileCopyrightText: 2022 2022 Marshall Wace <opensource@mwam.com>
+//
+// SPDX-License-Identifier: GPL3
+
+package slurm
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLicensesGetMetrics(t *testing.T) {
+	collector := NewLicensesCollector(true)
+	lm := collector.LicensesGetMetrics(context.Background())
+	assert.Len(t, lm, 3)
+	assert.Equal(t, &LicenseMetrics{total: 10, used: 4, free: 4, reserved: 2, pending: 2, pendingLics: 1}, lm["matlab"])
+	assert.Equal(t, &LicenseMetrics{total: 8, used: 8, pending: 1, pendingLics: 1}, lm["ansys"])
+	assert.Equal(t, []string{"matlab", "ansys@flex"}, parseJobLicenses("matlab:2|ansys@flex"))
+}
@@ -13,6 +13,7 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>. */
 package slurm
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"strconv"
@@ -29,6 +30,8 @@ const (
 
 var (
 	nodeResourcesLabels = []string{"name", "partition"}
+	nodeGresLabels      = []string{"name", "partition", "gres", "type"}
+	nodeTRESLabels      = []string{"name", "partition", "tres"}
 )
 
 type nodesCollector struct {
@@ -41,6 +44,10 @@ type nodesCollector struct {
 	scontrolNodeMemoryFree      *prometheus.GaugeVec
 	scontrolNodeGPUTot          *prometheus.GaugeVec
 	scontrolNodeGPUFree         *prometheus.GaugeVec
+	scontrolNodeGresTot         *prometheus.GaugeVec
+	scontrolNodeGresUsed        *prometheus.GaugeVec
+	scontrolNodeTRES            *prometheus.GaugeVec
+	scontrolNodeTRESUsed        *prometheus.GaugeVec
 	isTest                      bool
 	nodeAddressSuffix           string
 
@@ -132,6 +139,34 @@ func NewNodesCollector(isTest bool, nodeAddressSuffix string) *nodesCollector {
 				Help:      "Number of free GPU on the node.",
 			},
 			nodeResourcesLabels),
+		scontrolNodeGresTot: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Subsystem: "",
+				Name:      "slurm_node_gres_total",
+				Help:      "Number of generic resources on the node, by GRES name and type.",
+			},
+			nodeGresLabels),
+		scontrolNodeGresUsed: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Subsystem: "",
+				Name:      "slurm_node_gres_used",
+				Help:      "Number of generic resources in use on the node, by GRES name and type.",
+			},
+			nodeGresLabels),
+		scontrolNodeTRES: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Subsystem: "",
+				Name:      "slurm_node_tres",
+				Help:      "Trackable resources of the node, sizes in bytes.",
+			},
+			nodeTRESLabels),
+		scontrolNodeTRESUsed: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Subsystem: "",
+				Name:      "slurm_node_tres_used",
+				Help:      "Trackable resources in use on the node, sizes in bytes.",
+			},
+			nodeTRESLabels),
 
 		// Old metrics, keeping them for dashboards/alerts compatibility reasons
 
@@ -240,14 +275,23 @@ func NewNodesCollector(isTest bool, nodeAddressSuffix string) *nodesCollector {
 	}
 }
 
-func (s *nodesCollector) getNodesMetrics() {
-	nodes := &NodeDetails{}
-	data := getData(s.isTest, showNodesDetailsCommand, showNodesDetailsTestDataInput)
-	err := json.Unmarshal([]byte(data), nodes)
-	if err != nil {
-		ExporterErrors.WithLabelValues("json-encoding-sinfo-nodes", err.Error()).Inc()
-		fmt.Println(err)
-	}
+// getNodes returns the nodes reported by sinfo, shared by the collectors
+// within a scrape.
+func getNodes(ctx context.Context, isTest bool) *NodeDetails {
+	return cached(ctx, showNodesDetailsCommand, func() interface{} {
+		nodes := &NodeDetails{}
+		data := getData(ctx, isTest, showNodesDetailsCommand, showNodesDetailsTestDataInput)
+		err := json.Unmarshal([]byte(data), nodes)
+		if err != nil {
+			ExporterErrors.WithLabelValues("json-encoding-sinfo-nodes", err.Error()).Inc()
+			fmt.Println(err)
+		}
+		return nodes
+	}).(*NodeDetails)
+}
+
+func (s *nodesCollector) getNodesMetrics(ctx context.Context) {
+	nodes := getNodes(ctx, s.isTest)
 	// create metrics from json object
 	for _, n := range nodes.Nodes {
 		// Prepare state and reason variables
@@ -256,6 +300,30 @@ func (s *nodesCollector) getNodesMetrics() {
 		if n.Reason != "" {
 			reason = fmt.Sprintf("%s by %s", n.Reason, n.ReasonSetByUser)
 		}
+		gresTot, err := ParseGres(n.Gres)
+		if err != nil {
+			ExporterErrors.WithLabelValues("parse-gres", err.Error()).Inc()
+			fmt.Println(err)
+		}
+		gresUsed, err := ParseGres(n.GresUsed)
+		if err != nil {
+			ExporterErrors.WithLabelValues("parse-gres-used", err.Error()).Inc()
+			fmt.Println(err)
+		}
+		total := gresCounts(gresTot)
+		used := gresUsage(total, gresCounts(gresUsed))
+		gpuTot := gresTotal(total, "gpu")
+		// Untyped usage cannot always be matched to a type, the GPUs in use
+		// are counted whatever their type
+		gpuUsed := gresTotal(gresCounts(gresUsed), "gpu")
+		tres := parseTRES(n.Tres)
+		tresUsed := parseTRES(n.TresUsed)
+		// tres_used leaves out the resources which are not in use
+		for name := range tres {
+			if _, ok := tresUsed[name]; !ok {
+				tresUsed[name] = 0
+			}
+		}
 		// Iterating over partitions and active_features
 		for _, partition := range n.Partitions {
 			for _, feature := range strings.Split(n.ActiveFeatures, ",") {
@@ -269,28 +337,20 @@ func (s *nodesCollector) getNodesMetrics() {
 			s.scontrolNodeMemoryTot.WithLabelValues(n.Name, partition).Set(float64(n.RealMemory))
 			s.scontrolNodeMemoryFree.WithLabelValues(n.Name, partition).Set(float64(n.FreeMemory))
 			s.scontrolNodeMemoryAllocated.WithLabelValues(n.Name, partition).Set(float64(n.AllocMemory))
-			gpuTot := 0
-			if n.Gres != "" {
-				// this is a bit obscure, but the standard gres configuration is `gpu:nvidia:3` and we need to get the 3
-				gpuTot, err = strconv.Atoi(strings.Split(n.Gres, ":")[2])
-				if err != nil {
-					ExporterErrors.WithLabelValues("atoi-gpu-tot", err.Error()).Inc()
-					fmt.Println(err)
-				}
-
+			s.scontrolNodeGPUTot.WithLabelValues(n.Name, partition).Set(gpuTot)
+			s.scontrolNodeGPUFree.WithLabelValues(n.Name, partition).Set(gpuTot - gpuUsed)
+			for key, count := range total {
+				s.scontrolNodeGresTot.WithLabelValues(n.Name, partition, key.name, key.gresType).Set(count)
 			}
-			gpuUsed := 0
-			if n.GresUsed != "gpu:0" {
-				// this is a bit obscure, but the standard gres configuration is `gpu:nvidia:0(IDX:N\/A)` and we need to get the 0
-				gpuUsed, err = strconv.Atoi(strings.Split(strings.Split(n.GresUsed, "(")[0], ":")[2])
-				if err != nil {
-					ExporterErrors.WithLabelValues("atoi-gpu-used", err.Error()).Inc()
-					fmt.Println(err)
-				}
+			for key, count := range used {
+				s.scontrolNodeGresUsed.WithLabelValues(n.Name, partition, key.name, key.gresType).Set(count)
+			}
+			for name, value := range tres {
+				s.scontrolNodeTRES.WithLabelValues(n.Name, partition, name).Set(value)
+			}
+			for name, value := range tresUsed {
+				s.scontrolNodeTRESUsed.WithLabelValues(n.Name, partition, name).Set(value)
 			}
-			s.scontrolNodeGPUTot.WithLabelValues(n.Name, partition).Set(float64(gpuTot))
-			s.scontrolNodeGPUFree.WithLabelValues(n.Name, partition).Set(float64(gpuTot - gpuUsed))
-
 		}
 
 		// Old metrics, keeping them for dashboards/alerts compatibility reasons
@@ -364,6 +424,10 @@ func (s *nodesCollector) Describe(ch chan<- *prometheus.Desc) {
 	s.scontrolNodeMemoryTot.Describe(ch)
 	s.scontrolNodeGPUTot.Describe(ch)
 	s.scontrolNodeGPUFree.Describe(ch)
+	s.scontrolNodeGresTot.Describe(ch)
+	s.scontrolNodeGresUsed.Describe(ch)
+	s.scontrolNodeTRES.Describe(ch)
+	s.scontrolNodeTRESUsed.Describe(ch)
 	// Old metrics, keeping them for dashboards/alerts compatibility reasons
 	s.cpuAlloc.Describe(ch)
 	s.cpuIdle.Describe(ch)
@@ -384,7 +448,7 @@ func (s *nodesCollector) Describe(ch chan<- *prometheus.Desc) {
 	s.resv.Describe(ch)
 }
 
-func (s *nodesCollector) Collect(ch chan<- prometheus.Metric) {
+func (s *nodesCollector) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) {
 	s.scontrolNodesInfo.Reset()
 	s.scontrolNodeCPUAllocated.Reset()
 	s.scontrolNodeCPULoad.Reset()
@@ -394,6 +458,10 @@ func (s *nodesCollector) Collect(ch chan<- prometheus.Metric) {
 	s.scontrolNodeMemoryTot.Reset()
 	s.scontrolNodeGPUFree.Reset()
 	s.scontrolNodeGPUTot.Reset()
+	s.scontrolNodeGresTot.Reset()
+	s.scontrolNodeGresUsed.Reset()
+	s.scontrolNodeTRES.Reset()
+	s.scontrolNodeTRESUsed.Reset()
 	// Old metrics, keeping them for dashboards/alerts compatibility reasons
 	s.cpuAlloc.Reset()
 	s.cpuIdle.Reset()
@@ -412,7 +480,7 @@ func (s *nodesCollector) Collect(ch chan<- prometheus.Metric) {
 	s.maint.Reset()
 	s.mix.Reset()
 	s.resv.Reset()
-	s.getNodesMetrics()
+	s.getNodesMetrics(ctx)
 	s.scontrolNodesInfo.Collect(ch)
 	s.scontrolNodeCPUAllocated.Collect(ch)
 	s.scontrolNodeCPULoad.Collect(ch)
@@ -421,6 +489,10 @@ func (s *nodesCollector) Collect(ch chan<- prometheus.Metric) {
 	s.scontrolNodeMemoryFree.Collect(ch)
 	s.scontrolNodeMemoryTot.Collect(ch)
 	s.scontrolNodeGPUFree.Collect(ch)
+	s.scontrolNodeGresTot.Collect(ch)
+	s.scontrolNodeGresUsed.Collect(ch)
+	s.scontrolNodeTRES.Collect(ch)
+	s.scontrolNodeTRESUsed.Collect(ch)
 	s.scontrolNodeGPUTot.Collect(ch)
 	// Old metrics, keeping them for dashboards/alerts compatibility reasons
 	s.cpuAlloc.Collect(ch)
@@ -458,51 +530,53 @@ type NodeDetails struct {
 		} `json:"Slurm"`
 	} `json:"meta"`
 	Errors []interface{} `json:"errors"`
-	Nodes  []struct {
-		Architecture              string      `json:"architecture"`
-		BurstbufferNetworkAddress string      `json:"burstbuffer_network_address"`
-		Boards                    int         `json:"boards"`
-		BootTime                  int         `json:"boot_time"`
-		Comment                   string      `json:"comment"`
-		Cores                     int         `json:"cores"`
-		CPUBinding                int         `json:"cpu_binding"`
-		CPULoad                   int         `json:"cpu_load"`
-		Extra                     string      `json:"extra"`
-		FreeMemory                int         `json:"free_memory"`
-		Cpus                      int         `json:"cpus"`
-		LastBusy                  int         `json:"last_busy"`
-		Features                  string      `json:"features"`
-		ActiveFeatures            string      `json:"active_features"`
-		Gres                      string      `json:"gres"`
-		GresDrained               string      `json:"gres_drained"`
-		GresUsed                  string      `json:"gres_used"`
-		McsLabel                  string      `json:"mcs_label"`
-		Name                      string      `json:"name"`
-		NextStateAfterReboot      string      `json:"next_state_after_reboot"`
-		Address                   string      `json:"address"`
-		Hostname                  string      `json:"hostname"`
-		State                     string      `json:"state"`
-		StateFlags                []string    `json:"state_flags"`
-		NextStateAfterRebootFlags []string    `json:"next_state_after_reboot_flags"`
-		OperatingSystem           string      `json:"operating_system"`
-		Owner                     interface{} `json:"owner"`
-		Partitions                []string    `json:"partitions"`
-		Port                      int         `json:"port"`
-		RealMemory                int         `json:"real_memory"`
-		Reason                    string      `json:"reason"`
-		ReasonChangedAt           int         `json:"reason_changed_at"`
-		ReasonSetByUser           interface{} `json:"reason_set_by_user"`
-		SlurmdStartTime           int         `json:"slurmd_start_time"`
-		Sockets                   int         `json:"sockets"`
-		Threads                   int         `json:"threads"`
-		TemporaryDisk             int         `json:"temporary_disk"`
-		Weight                    int         `json:"weight"`
-		Tres                      string      `json:"tres"`
-		SlurmdVersion             string      `json:"slurmd_version"`
-		AllocMemory               int         `json:"alloc_memory"`
-		AllocCpus                 int         `json:"alloc_cpus"`
-		IdleCpus                  int         `json:"idle_cpus"`
-		TresUsed                  string      `json:"tres_used"`
-		TresWeighted              float64     `json:"tres_weighted"`
-	} `json:"nodes"`
+	Nodes  []NodeDetail  `json:"nodes"`
+}
+
+type NodeDetail struct {
+	Architecture              string      `json:"architecture"`
+	BurstbufferNetworkAddress string      `json:"burstbuffer_network_address"`
+	Boards                    int         `json:"boards"`
+	BootTime                  int         `json:"boot_time"`
+	Comment                   string      `json:"comment"`
+	Cores                     int         `json:"cores"`
+	CPUBinding                int         `json:"cpu_binding"`
+	CPULoad                   int         `json:"cpu_load"`
+	Extra                     string      `json:"extra"`
+	FreeMemory                int         `json:"free_memory"`
+	Cpus                      int         `json:"cpus"`
+	LastBusy                  int         `json:"last_busy"`
+	Features                  string      `json:"features"`
+	ActiveFeatures            string      `json:"active_features"`
+	Gres                      string      `json:"gres"`
+	GresDrained               string      `json:"gres_drained"`
+	GresUsed                  string      `json:"gres_used"`
+	McsLabel                  string      `json:"mcs_label"`
+	Name                      string      `json:"name"`
+	NextStateAfterReboot      string      `json:"next_state_after_reboot"`
+	Address                   string      `json:"address"`
+	Hostname                  string      `json:"hostname"`
+	State                     string      `json:"state"`
+	StateFlags                []string    `json:"state_flags"`
+	NextStateAfterRebootFlags []string    `json:"next_state_after_reboot_flags"`
+	OperatingSystem           string      `json:"operating_system"`
+	Owner                     interface{} `json:"owner"`
+	Partitions                []string    `json:"partitions"`
+	Port                      int         `json:"port"`
+	RealMemory                int         `json:"real_memory"`
+	Reason                    string      `json:"reason"`
+	ReasonChangedAt           int         `json:"reason_changed_at"`
+	ReasonSetByUser           interface{} `json:"reason_set_by_user"`
+	SlurmdStartTime           int         `json:"slurmd_start_time"`
+	Sockets                   int         `json:"sockets"`
+	Threads                   int         `json:"threads"`
+	TemporaryDisk             int         `json:"temporary_disk"`
+	Weight                    int         `json:"weight"`
+	Tres                      string      `json:"tres"`
+	SlurmdVersion             string      `json:"slurmd_version"`
+	AllocMemory               int         `json:"alloc_memory"`
+	AllocCpus                 int         `json:"alloc_cpus"`
+	IdleCpus                  int         `json:"idle_cpus"`
+	TresUsed                  string      `json:"tres_used"`
+	TresWeighted              float64     `json:"tres_weighted"`
 }
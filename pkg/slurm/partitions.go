@@ -3,12 +3,38 @@
 package slurm
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"strconv"
 	"strings"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+const (
+	partitionsCommand  = "scontrol show partition --json"
+	partitionsTestData = "test_data/partitions.json"
+)
+
+var partitionStates = []string{"UP", "DOWN", "DRAIN", "INACTIVE"}
+
+type PartitionsOutput struct {
+	Partitions []struct {
+		Flags            []string    `json:"flags"`
+		PreemptionMode   string      `json:"preemption_mode"`
+		DefaultTimeLimit slurmNumber `json:"default_time_limit"`
+		MaxNodesPerJob   slurmNumber `json:"maximum_nodes_per_job"`
+		MaxTimeLimit     slurmNumber `json:"max_time_limit"`
+		Name             string      `json:"name"`
+		// OverSubscribe is missing from the output of some Slurm releases
+		OverSubscribe string      `json:"oversubscribe"`
+		PriorityTier  slurmNumber `json:"priority_tier"`
+		State         string      `json:"state"`
+		TotalNodes    slurmNumber `json:"total_nodes"`
+	} `json:"partitions"`
+}
+
 type PartitionMetrics struct {
 	allocated float64
 	idle      float64
@@ -18,9 +44,9 @@ type PartitionMetrics struct {
 	total     float64
 }
 
-func ParsePartitionsMetrics() map[string]*PartitionMetrics {
+func ParsePartitionsMetrics(ctx context.Context) map[string]*PartitionMetrics {
 	partitions := make(map[string]*PartitionMetrics)
-	out := execCommand("sinfo -h -o%R,%C")
+	out := execCommand(ctx, "sinfo -h -o%R,%C")
 	lines := strings.Split(out, "\n")
 	for _, line := range lines {
 		if strings.Contains(line, ",") {
@@ -42,7 +68,7 @@ func ParsePartitionsMetrics() map[string]*PartitionMetrics {
 		}
 	}
 	// get list of pending jobs by partition name
-	pendingOut := execCommand("squeue -a -r -h -o%P --states=PENDING")
+	pendingOut := execCommand(ctx, "squeue -a -r -h -o%P --states=PENDING")
 	list := strings.Split(pendingOut, "\n")
 	for _, partition := range list {
 		// accumulate the number of pending jobs
@@ -53,7 +79,7 @@ func ParsePartitionsMetrics() map[string]*PartitionMetrics {
 	}
 
 	// get list of running jobs by partition name
-	runningOut := execCommand("squeue -a -r -h -o%P --states=RUNNING")
+	runningOut := execCommand(ctx, "squeue -a -r -h -o%P --states=RUNNING")
 	list_r := strings.Split(runningOut, "\n")
 	for _, partition := range list_r {
 		// accumulate the number of running jobs
@@ -66,24 +92,146 @@ func ParsePartitionsMetrics() map[string]*PartitionMetrics {
 	return partitions
 }
 
+func (pc *PartitionsCollector) getPartitions(ctx context.Context) *PartitionsOutput {
+	data := getData(ctx, pc.isTest, partitionsCommand, partitionsTestData)
+	partitions := &PartitionsOutput{}
+	err := json.Unmarshal([]byte(data), partitions)
+	if err != nil {
+		ExporterErrors.WithLabelValues("json-encoding-partitions", err.Error()).Inc()
+		fmt.Println(err)
+	}
+	return partitions
+}
+
+// idleNodes counts the nodes of every partition which are idle, and
+// available as defined by nodeAvailable.
+func idleNodes(nodes *NodeDetails) map[string]float64 {
+	idle := make(map[string]float64)
+	for _, n := range nodes.Nodes {
+		if strings.ToUpper(n.State) != "IDLE" || !nodeAvailable(n) {
+			continue
+		}
+		for _, partition := range n.Partitions {
+			idle[partition]++
+		}
+	}
+	return idle
+}
+
+// partitionResource is a resource of the nodes of a partition, split like
+// the CPUs reported by sinfo: what is left of the nodes which are drained or
+// down is neither idle nor allocated but other.
+type partitionResource struct {
+	allocated float64
+	idle      float64
+	other     float64
+	total     float64
+}
+
+func (r *partitionResource) add(total, allocated float64, available bool) {
+	r.total += total
+	r.allocated += allocated
+	if available {
+		r.idle += total - allocated
+	} else {
+		r.other += total - allocated
+	}
+}
+
+// nodeAvailable tells whether jobs can be scheduled on the node. It is the
+// only definition of availability of the partition metrics, for the nodes as
+// for the memory and the GPUs.
+func nodeAvailable(n NodeDetail) bool {
+	switch strings.ToUpper(n.State) {
+	case "DOWN", "ERROR", "FAIL", "FUTURE", "UNKNOWN":
+		return false
+	}
+	for _, flag := range n.StateFlags {
+		switch strings.ToUpper(flag) {
+		case "DRAIN", "FAIL", "MAINT", "NOT_RESPONDING":
+			return false
+		}
+	}
+	return true
+}
+
+// partitionResources sums the memory, in bytes, and the GPUs of the nodes of
+// every partition.
+func partitionResources(nodes *NodeDetails) (memory map[string]*partitionResource, gpus map[string]*partitionResource) {
+	memory = make(map[string]*partitionResource)
+	gpus = make(map[string]*partitionResource)
+	for _, n := range nodes.Nodes {
+		available := nodeAvailable(n)
+		tres := parseTRES(n.Tres)
+		tresUsed := parseTRES(n.TresUsed)
+		for _, partition := range n.Partitions {
+			if memory[partition] == nil {
+				memory[partition] = &partitionResource{}
+				gpus[partition] = &partitionResource{}
+			}
+			memory[partition].add(float64(n.RealMemory)*mebibyte, float64(n.AllocMemory)*mebibyte, available)
+			gpus[partition].add(tres["gres/gpu"], tresUsed["gres/gpu"], available)
+		}
+	}
+	return memory, gpus
+}
+
 type PartitionsCollector struct {
+	isTest    bool
 	allocated *prometheus.Desc
 	idle      *prometheus.Desc
 	other     *prometheus.Desc
 	pending   *prometheus.Desc
 	running   *prometheus.Desc
 	total     *prometheus.Desc
+
+	// From scontrol show partition
+	info        *prometheus.Desc
+	state       *prometheus.Desc
+	maxTime     *prometheus.Desc
+	defaultTime *prometheus.Desc
+	maxNodes    *prometheus.Desc
+	tier        *prometheus.Desc
+	nodesTotal  *prometheus.Desc
+	nodesIdle   *prometheus.Desc
+
+	// From the nodes of the partition
+	memory map[string]*prometheus.Desc
+	gpus   map[string]*prometheus.Desc
 }
 
-func NewPartitionsCollector() *PartitionsCollector {
+// partitionResourceDescs returns the allocated, idle, other and total
+// descriptors of a resource, mirroring slurm_partition_cpus_*.
+func partitionResourceDescs(name, unit, noun string) map[string]*prometheus.Desc {
+	labels := []string{"partition"}
+	return map[string]*prometheus.Desc{
+		"allocated": prometheus.NewDesc("slurm_partition_"+name+"_allocated"+unit, "Allocated "+noun+" for partition", labels, nil),
+		"idle":      prometheus.NewDesc("slurm_partition_"+name+"_idle"+unit, "Idle "+noun+" for partition", labels, nil),
+		"other":     prometheus.NewDesc("slurm_partition_"+name+"_other"+unit, "Other "+noun+", on drained or down nodes, for partition", labels, nil),
+		"total":     prometheus.NewDesc("slurm_partition_"+name+"_total"+unit, "Total "+noun+" for partition", labels, nil),
+	}
+}
+
+func NewPartitionsCollector(isTest bool) *PartitionsCollector {
 	labels := []string{"partition"}
 	return &PartitionsCollector{
-		allocated: prometheus.NewDesc("slurm_partition_cpus_allocated", "Allocated CPUs for partition", labels, nil),
-		idle:      prometheus.NewDesc("slurm_partition_cpus_idle", "Idle CPUs for partition", labels, nil),
-		other:     prometheus.NewDesc("slurm_partition_cpus_other", "Other CPUs for partition", labels, nil),
-		pending:   prometheus.NewDesc("slurm_partition_jobs_pending", "Pending jobs for partition", labels, nil),
-		running:   prometheus.NewDesc("slurm_partition_jobs_running", "Running jobs for partition", labels, nil),
-		total:     prometheus.NewDesc("slurm_partition_cpus_total", "Total CPUs for partition", labels, nil),
+		isTest:      isTest,
+		allocated:   prometheus.NewDesc("slurm_partition_cpus_allocated", "Allocated CPUs for partition", labels, nil),
+		idle:        prometheus.NewDesc("slurm_partition_cpus_idle", "Idle CPUs for partition", labels, nil),
+		other:       prometheus.NewDesc("slurm_partition_cpus_other", "Other CPUs for partition", labels, nil),
+		pending:     prometheus.NewDesc("slurm_partition_jobs_pending", "Pending jobs for partition", labels, nil),
+		running:     prometheus.NewDesc("slurm_partition_jobs_running", "Running jobs for partition", labels, nil),
+		total:       prometheus.NewDesc("slurm_partition_cpus_total", "Total CPUs for partition", labels, nil),
+		info:        prometheus.NewDesc("slurm_partition_info", "Configuration of the partition", []string{"partition", "preempt_mode", "oversubscribe", "flags"}, nil),
+		state:       prometheus.NewDesc("slurm_partition_state", "State of the partition, 1 for the current one", []string{"partition", "state"}, nil),
+		maxTime:     prometheus.NewDesc("slurm_partition_max_time_seconds", "Maximum run time of the jobs of the partition", labels, nil),
+		defaultTime: prometheus.NewDesc("slurm_partition_default_time_seconds", "Run time of the jobs of the partition without a time limit", labels, nil),
+		maxNodes:    prometheus.NewDesc("slurm_partition_max_nodes", "Maximum nodes per job of the partition", labels, nil),
+		tier:        prometheus.NewDesc("slurm_partition_priority_tier", "Priority tier of the partition", labels, nil),
+		nodesTotal:  prometheus.NewDesc("slurm_partition_nodes_total", "Total nodes for partition", labels, nil),
+		nodesIdle:   prometheus.NewDesc("slurm_partition_nodes_idle", "Idle nodes for partition", labels, nil),
+		memory:      partitionResourceDescs("memory", "_bytes", "memory"),
+		gpus:        partitionResourceDescs("gpus", "", "GPUs"),
 	}
 }
 
@@ -94,10 +242,81 @@ func (pc *PartitionsCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- pc.pending
 	ch <- pc.running
 	ch <- pc.total
+	ch <- pc.info
+	ch <- pc.state
+	ch <- pc.maxTime
+	ch <- pc.defaultTime
+	ch <- pc.maxNodes
+	ch <- pc.tier
+	ch <- pc.nodesTotal
+	ch <- pc.nodesIdle
+	for _, desc := range pc.memory {
+		ch <- desc
+	}
+	for _, desc := range pc.gpus {
+		ch <- desc
+	}
+}
+
+func (pc *PartitionsCollector) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	pc.collectCPUs(ctx, ch)
+	pc.collectConfig(ctx, ch)
+	pc.collectResources(ctx, ch)
+}
+
+func (pc *PartitionsCollector) collectResources(ctx context.Context, ch chan<- prometheus.Metric) {
+	memory, gpus := partitionResources(getNodes(ctx, pc.isTest))
+	for p, r := range memory {
+		pc.collectResource(ch, pc.memory, r, p)
+	}
+	for p, r := range gpus {
+		// Partitions without any GPU
+		if r.total == 0 {
+			continue
+		}
+		pc.collectResource(ch, pc.gpus, r, p)
+	}
+}
+
+func (pc *PartitionsCollector) collectResource(ch chan<- prometheus.Metric, descs map[string]*prometheus.Desc, r *partitionResource, partition string) {
+	ch <- prometheus.MustNewConstMetric(descs["allocated"], prometheus.GaugeValue, r.allocated, partition)
+	ch <- prometheus.MustNewConstMetric(descs["idle"], prometheus.GaugeValue, r.idle, partition)
+	ch <- prometheus.MustNewConstMetric(descs["other"], prometheus.GaugeValue, r.other, partition)
+	ch <- prometheus.MustNewConstMetric(descs["total"], prometheus.GaugeValue, r.total, partition)
+}
+
+func (pc *PartitionsCollector) collectConfig(ctx context.Context, ch chan<- prometheus.Metric) {
+	idle := idleNodes(getNodes(ctx, pc.isTest))
+	for _, p := range pc.getPartitions(ctx).Partitions {
+		ch <- prometheus.MustNewConstMetric(pc.info, prometheus.GaugeValue, 1, p.Name, p.PreemptionMode, p.OverSubscribe, strings.Join(p.Flags, ","))
+		for _, state := range partitionStates {
+			value := 0.0
+			if strings.EqualFold(p.State, state) {
+				value = 1
+			}
+			ch <- prometheus.MustNewConstMetric(pc.state, prometheus.GaugeValue, value, p.Name, state)
+		}
+		// Time limits are in minutes
+		if maxTime, ok := p.MaxTimeLimit.Float(); ok {
+			ch <- prometheus.MustNewConstMetric(pc.maxTime, prometheus.GaugeValue, maxTime*60, p.Name)
+		}
+		if defaultTime, ok := p.DefaultTimeLimit.Float(); ok {
+			ch <- prometheus.MustNewConstMetric(pc.defaultTime, prometheus.GaugeValue, defaultTime*60, p.Name)
+		}
+		if maxNodes, ok := p.MaxNodesPerJob.Float(); ok {
+			ch <- prometheus.MustNewConstMetric(pc.maxNodes, prometheus.GaugeValue, maxNodes, p.Name)
+		}
+		if tier, ok := p.PriorityTier.Float(); ok {
+			ch <- prometheus.MustNewConstMetric(pc.tier, prometheus.GaugeValue, tier, p.Name)
+		}
+		total, _ := p.TotalNodes.Float()
+		ch <- prometheus.MustNewConstMetric(pc.nodesTotal, prometheus.GaugeValue, total, p.Name)
+		ch <- prometheus.MustNewConstMetric(pc.nodesIdle, prometheus.GaugeValue, idle[p.Name], p.Name)
+	}
 }
 
-func (pc *PartitionsCollector) Collect(ch chan<- prometheus.Metric) {
-	pm := ParsePartitionsMetrics()
+func (pc *PartitionsCollector) collectCPUs(ctx context.Context, ch chan<- prometheus.Metric) {
+	pm := ParsePartitionsMetrics(ctx)
 	for p := range pm {
 		if pm[p].allocated > 0 {
 			ch <- prometheus.MustNewConstMetric(pc.allocated, prometheus.GaugeValue, pm[p].allocated, p)
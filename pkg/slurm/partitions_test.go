@@ -0,0 +1,114 @@
+// SPDX-FileCopyrightText: 2022 2022 Marshall Wace <opensource@mwam.com>
+//
+// SPDX-License-Identifier: GPL3
+
+package slurm
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// partitionsConfig leaves out the CPU metrics, which have no test data.
+type partitionsConfig struct {
+	*PartitionsCollector
+}
+
+func (pc partitionsConfig) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	pc.collectConfig(ctx, ch)
+	pc.collectResources(ctx, ch)
+}
+
+func TestPartitionsConfig(t *testing.T) {
+	ctx := withScrapeCache(context.Background())
+	collector := &scrapeCollector{ctx: ctx, collector: partitionsConfig{NewPartitionsCollector(true)}}
+	expected := `
+# HELP slurm_partition_max_nodes Maximum nodes per job of the partition
+# TYPE slurm_partition_max_nodes gauge
+slurm_partition_max_nodes{partition="debug"} 1
+slurm_partition_max_nodes{partition="gpu"} +Inf
+slurm_partition_max_nodes{partition="normal"} +Inf
+slurm_partition_max_nodes{partition="old"} 0
+# HELP slurm_partition_default_time_seconds Run time of the jobs of the partition without a time limit
+# TYPE slurm_partition_default_time_seconds gauge
+slurm_partition_default_time_seconds{partition="debug"} 1800
+slurm_partition_default_time_seconds{partition="normal"} 3600
+slurm_partition_default_time_seconds{partition="old"} 0
+# HELP slurm_partition_max_time_seconds Maximum run time of the jobs of the partition
+# TYPE slurm_partition_max_time_seconds gauge
+slurm_partition_max_time_seconds{partition="debug"} 3600
+slurm_partition_max_time_seconds{partition="gpu"} 86400
+slurm_partition_max_time_seconds{partition="normal"} 259200
+slurm_partition_max_time_seconds{partition="old"} +Inf
+# HELP slurm_partition_nodes_idle Idle nodes for partition
+# TYPE slurm_partition_nodes_idle gauge
+slurm_partition_nodes_idle{partition="debug"} 0
+slurm_partition_nodes_idle{partition="gpu"} 1
+slurm_partition_nodes_idle{partition="normal"} 1
+slurm_partition_nodes_idle{partition="old"} 0
+`
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(expected),
+		"slurm_partition_max_nodes", "slurm_partition_default_time_seconds", "slurm_partition_max_time_seconds", "slurm_partition_nodes_idle"))
+
+	// One state per partition is set
+	assert.Equal(t, 4*len(partitionStates), testutil.CollectAndCount(collector, "slurm_partition_state"))
+	expected = `
+# HELP slurm_partition_info Configuration of the partition
+# TYPE slurm_partition_info gauge
+slurm_partition_info{flags="",oversubscribe="EXCLUSIVE",partition="gpu",preempt_mode="REQUEUE"} 1
+slurm_partition_info{flags="",oversubscribe="FORCE:4",partition="debug",preempt_mode="OFF"} 1
+slurm_partition_info{flags="default",oversubscribe="NO",partition="normal",preempt_mode="OFF"} 1
+slurm_partition_info{flags="hidden",oversubscribe="NO",partition="old",preempt_mode="OFF"} 1
+`
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(expected), "slurm_partition_info"))
+}
+
+func TestPartitionResources(t *testing.T) {
+	collector := &scrapeCollector{ctx: withScrapeCache(context.Background()), collector: partitionsConfig{NewPartitionsCollector(true)}}
+	expected := `
+# HELP slurm_partition_gpus_allocated Allocated GPUs for partition
+# TYPE slurm_partition_gpus_allocated gauge
+slurm_partition_gpus_allocated{partition="gpu"} 2
+# HELP slurm_partition_gpus_idle Idle GPUs for partition
+# TYPE slurm_partition_gpus_idle gauge
+slurm_partition_gpus_idle{partition="gpu"} 6
+# HELP slurm_partition_gpus_other Other GPUs, on drained or down nodes, for partition
+# TYPE slurm_partition_gpus_other gauge
+slurm_partition_gpus_other{partition="gpu"} 0
+# HELP slurm_partition_gpus_total Total GPUs for partition
+# TYPE slurm_partition_gpus_total gauge
+slurm_partition_gpus_total{partition="gpu"} 8
+`
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(expected),
+		"slurm_partition_gpus_allocated", "slurm_partition_gpus_idle", "slurm_partition_gpus_other", "slurm_partition_gpus_total"))
+
+	// The drained and the down node of normal are other
+	memory, _ := partitionResources(getNodes(context.Background(), true))
+	assert.Equal(t, &partitionResource{
+		allocated: 192000 * mebibyte,
+		idle:      192000 * mebibyte,
+		other:     256000 * mebibyte,
+		total:     640000 * mebibyte,
+	}, memory["normal"])
+	assert.Equal(t, 64000.0*mebibyte, memory["debug"].idle)
+}
+
+func TestNodeAvailability(t *testing.T) {
+	// Nodes are idle and their resources idle under the same conditions
+	nodes := &NodeDetails{Nodes: []NodeDetail{
+		{Name: "a", State: "idle", Partitions: []string{"p"}, RealMemory: 1},
+		{Name: "b", State: "idle", StateFlags: []string{"DRAIN"}, Partitions: []string{"p"}, RealMemory: 1},
+		{Name: "c", State: "idle", StateFlags: []string{"MAINT"}, Partitions: []string{"p"}, RealMemory: 1},
+		{Name: "d", State: "idle", StateFlags: []string{"NOT_RESPONDING"}, Partitions: []string{"p"}, RealMemory: 1},
+		{Name: "e", State: "mixed", Partitions: []string{"p"}, RealMemory: 1},
+	}}
+	memory, _ := partitionResources(nodes)
+	assert.Equal(t, 1.0, idleNodes(nodes)["p"])
+	assert.Equal(t, float64(2*mebibyte), memory["p"].idle)
+	assert.Equal(t, float64(3*mebibyte), memory["p"].other)
+}
@@ -0,0 +1,92 @@
+// SPDX-FileCopyrightText: 2022 2022 Marshall Wace <opensource@mwam.com>
+//
+// SPDX-License-Identifier: GPL3
+
+package slurm
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+/*
+ * Implement the Prometheus Collector interface and feed the
+ * time pending jobs have been and are expected to be waiting into it.
+ * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
+ */
+
+type PendingCollector struct {
+	isTest      bool
+	now         func() time.Time
+	age         *prometheus.Desc
+	oldestReady *prometheus.Desc
+	wait        *prometheus.Desc
+	noStart     *prometheus.Desc
+}
+
+func NewPendingCollector(isTest bool) *PendingCollector {
+	return &PendingCollector{
+		isTest:      isTest,
+		now:         time.Now,
+		age:         prometheus.NewDesc("slurm_pending_job_age_seconds", "Time pending jobs have been waiting since their submission", []string{"partition", "account"}, nil),
+		oldestReady: prometheus.NewDesc("slurm_pending_job_oldest_eligible_age_seconds", "Time the oldest eligible pending job has been waiting since it became eligible", []string{"partition"}, nil),
+		wait:        prometheus.NewDesc("slurm_pending_job_expected_wait_seconds", "Time pending jobs are expected to wait until the start time predicted by the scheduler", []string{"partition"}, nil),
+		noStart:     prometheus.NewDesc("slurm_pending_jobs_without_expected_start", "Pending jobs the scheduler predicted no start time for", []string{"partition"}, nil),
+	}
+}
+
+func (pc *PendingCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pc.age
+	ch <- pc.oldestReady
+	ch <- pc.wait
+	ch <- pc.noStart
+}
+
+func (pc *PendingCollector) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	now := float64(pc.now().Unix())
+	ages := make(map[[2]string]*constHistogram)
+	oldest := make(map[string]float64)
+	waits := make(map[string]*constHistogram)
+	noStart := make(map[string]float64)
+	for _, job := range getJobs(ctx, pc.isTest).Jobs {
+		// The components of a heterogeneous job make up a single job
+		if job.JobState != "PENDING" || job.HetJobOffset > 0 {
+			continue
+		}
+		key := [2]string{job.Partition, job.Account}
+		if ages[key] == nil {
+			ages[key] = newConstHistogram(durationBuckets)
+		}
+		ages[key].observe(now - float64(job.SubmitTime))
+		// The start time of pending jobs is the one predicted by the
+		// backfill scheduler, if any
+		if waits[job.Partition] == nil {
+			waits[job.Partition] = newConstHistogram(durationBuckets)
+		}
+		if job.StartTime == 0 {
+			noStart[job.Partition]++
+		} else {
+			waits[job.Partition].observe(math.Max(float64(job.StartTime)-now, 0))
+		}
+		// Jobs waiting on a dependency or a begin time are not eligible yet
+		if job.EligibleTime == 0 || float64(job.EligibleTime) > now {
+			continue
+		}
+		if age := now - float64(job.EligibleTime); age > oldest[job.Partition] {
+			oldest[job.Partition] = age
+		}
+	}
+	for key, h := range ages {
+		ch <- h.metric(pc.age, key[0], key[1])
+	}
+	for partition, age := range oldest {
+		ch <- prometheus.MustNewConstMetric(pc.oldestReady, prometheus.GaugeValue, age, partition)
+	}
+	for partition, h := range waits {
+		ch <- h.metric(pc.wait, partition)
+		ch <- prometheus.MustNewConstMetric(pc.noStart, prometheus.GaugeValue, noStart[partition], partition)
+	}
+}
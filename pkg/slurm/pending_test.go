@@ -0,0 +1,45 @@
+// SPDX-FileCopyrightText: 2022 2022 Marshall Wace <opensource@mwam.com>
+//
+// SPDX-License-Identifier: GPL3
+
+package slurm
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// jobsTestTime is the time the squeue test data was taken at
+var jobsTestTime = time.Unix(1664618400, 0)
+
+func TestPendingCollector(t *testing.T) {
+	pc := NewPendingCollector(true)
+	pc.now = func() time.Time { return jobsTestTime }
+	collector := &scrapeCollector{ctx: context.Background(), collector: pc}
+
+	// The jobs waiting on a dependency are not eligible
+	expected := `
+# HELP slurm_pending_job_oldest_eligible_age_seconds Time the oldest eligible pending job has been waiting since it became eligible
+# TYPE slurm_pending_job_oldest_eligible_age_seconds gauge
+slurm_pending_job_oldest_eligible_age_seconds{partition="compute"} 7200
+slurm_pending_job_oldest_eligible_age_seconds{partition="gpu"} 600
+`
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(expected), "slurm_pending_job_oldest_eligible_age_seconds"))
+	// compute/physics, compute/biology and gpu/chemistry
+	assert.Equal(t, 3, testutil.CollectAndCount(collector, "slurm_pending_job_age_seconds"))
+
+	// Only 1003 got a start time from the backfill scheduler
+	expected = `
+# HELP slurm_pending_jobs_without_expected_start Pending jobs the scheduler predicted no start time for
+# TYPE slurm_pending_jobs_without_expected_start gauge
+slurm_pending_jobs_without_expected_start{partition="compute"} 4
+slurm_pending_jobs_without_expected_start{partition="gpu"} 1
+`
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(expected), "slurm_pending_jobs_without_expected_start"))
+	assert.Equal(t, 2, testutil.CollectAndCount(collector, "slurm_pending_job_expected_wait_seconds"))
+}
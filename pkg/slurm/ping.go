@@ -0,0 +1,149 @@
+// SPDX-FileCopyrightText: 2022 2022 Marshall Wace <opensource@mwam.com>
+//
+// SPDX-License-Identifier: GPL3
+
+package slurm
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	controllerPingCommand  = "scontrol ping"
+	controllerPingTestData = "test_data/scontrol_ping.txt"
+	dbdPingCommand         = "sacctmgr ping"
+	dbdPingTestData        = "test_data/sacctmgr_ping.txt"
+)
+
+// pingLine matches lines such as `Slurmctld(primary) at ctl01 is UP`. Older
+// Slurm releases report every controller on a single line, e.g.
+// `Slurmctld(primary/backup) at ctl01/ctl02 is UP/DOWN`.
+var pingLine = regexp.MustCompile(`^\s*\S+\(([^)]+)\) at (\S+) is (\S+)`)
+
+type PingStatus struct {
+	hostname string
+	mode     string
+	up       bool
+}
+
+// ParsePingOutput extracts the status of every daemon from the output of
+// `scontrol ping` or `sacctmgr ping`.
+func ParsePingOutput(out string) []PingStatus {
+	var statuses []PingStatus
+	for _, line := range strings.Split(out, "\n") {
+		m := pingLine.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		modes := strings.Split(m[1], "/")
+		hosts := strings.Split(m[2], "/")
+		states := strings.Split(m[3], "/")
+		for i, host := range hosts {
+			st := PingStatus{hostname: host}
+			if i < len(modes) {
+				st.mode = modes[i]
+			}
+			if i < len(states) {
+				st.up = strings.ToUpper(states[i]) == "UP"
+			}
+			statuses = append(statuses, st)
+		}
+	}
+	return statuses
+}
+
+type daemonPing struct {
+	command  string
+	testData string
+	up       *prometheus.Desc
+	duration *prometheus.Desc
+	// last known daemons, reported as down when the ping gives nothing
+	// usable at all
+	mu   sync.Mutex
+	last []PingStatus
+}
+
+func (d *daemonPing) ping(ctx context.Context, isTest bool) ([]PingStatus, float64) {
+	var out string
+	before := time.Now()
+	if isTest {
+		out = readFile(d.testData)
+	} else {
+		// A failed ping still tells which daemons are down
+		out, _ = probeCommand(ctx, d.command, strings.Split(d.command, " "))
+	}
+	elapsed := time.Since(before).Seconds()
+	statuses := ParsePingOutput(out)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(statuses) == 0 {
+		for _, st := range d.last {
+			statuses = append(statuses, PingStatus{hostname: st.hostname, mode: st.mode})
+		}
+	} else {
+		d.last = statuses
+	}
+	return statuses, elapsed
+}
+
+func (d *daemonPing) collect(ctx context.Context, isTest bool, ch chan<- prometheus.Metric) {
+	statuses, elapsed := d.ping(ctx, isTest)
+	for _, st := range statuses {
+		up := 0.0
+		if st.up {
+			up = 1
+		}
+		ch <- prometheus.MustNewConstMetric(d.up, prometheus.GaugeValue, up, st.hostname, st.mode)
+	}
+	ch <- prometheus.MustNewConstMetric(d.duration, prometheus.GaugeValue, elapsed)
+}
+
+/*
+ * Implement the Prometheus Collector interface and feed the
+ * Slurm daemons reachability into it.
+ * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
+ */
+
+type PingCollector struct {
+	isTest     bool
+	controller *daemonPing
+	dbd        *daemonPing
+}
+
+func NewPingCollector(isTest bool) *PingCollector {
+	labels := []string{"hostname", "mode"}
+	return &PingCollector{
+		isTest: isTest,
+		controller: &daemonPing{
+			command:  controllerPingCommand,
+			testData: controllerPingTestData,
+			up:       prometheus.NewDesc("slurm_controller_up", "Whether slurmctld answers to scontrol ping", labels, nil),
+			duration: prometheus.NewDesc("slurm_controller_ping_duration_seconds", "Time taken by scontrol ping to reach all the controllers", nil, nil),
+		},
+		dbd: &daemonPing{
+			command:  dbdPingCommand,
+			testData: dbdPingTestData,
+			up:       prometheus.NewDesc("slurm_dbd_up", "Whether slurmdbd answers to sacctmgr ping", labels, nil),
+			duration: prometheus.NewDesc("slurm_dbd_ping_duration_seconds", "Time taken by sacctmgr ping to reach all the slurmdbd daemons", nil, nil),
+		},
+	}
+}
+
+func (pc *PingCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pc.controller.up
+	ch <- pc.controller.duration
+	ch <- pc.dbd.up
+	ch <- pc.dbd.duration
+}
+
+func (pc *PingCollector) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	pc.controller.collect(ctx, pc.isTest, ch)
+	pc.dbd.collect(ctx, pc.isTest, ch)
+}
@@ -0,0 +1,25 @@
+// SPDX-FileCopyrightText: 2022 2022 Marshall Wace <opensource@mwam.com>
+//
+// SPDX-License-Identifier: GPL3
+
+package slurm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePingOutput(t *testing.T) {
+	statuses := ParsePingOutput(readFile(controllerPingTestData))
+	assert.Equal(t, []PingStatus{
+		{hostname: "ctl01", mode: "primary", up: true},
+		{hostname: "ctl02", mode: "backup", up: false},
+	}, statuses)
+
+	statuses = ParsePingOutput("Slurmctld(primary/backup) at ctl01/ctl02 is UP/DOWN\n")
+	assert.Equal(t, []PingStatus{
+		{hostname: "ctl01", mode: "primary", up: true},
+		{hostname: "ctl02", mode: "backup", up: false},
+	}, statuses)
+}
@@ -0,0 +1,198 @@
+// SPDX-FileCopyrightText: 2022 2022 Marshall Wace <opensource@mwam.com>
+//
+// SPDX-License-Identifier: GPL3
+
+package slurm
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	qosTestData = "test_data/qos.txt"
+)
+
+var (
+	qosFields  = []string{"Name", "Priority", "PreemptMode", "GrpTRES", "GrpJobs", "GrpSubmitJobs", "MaxTRESPerUser", "MaxJobsPerUser", "MaxSubmitJobsPerUser", "MaxTRESPerJob", "MaxWall"}
+	qosCommand = "sacctmgr show qos -n -P format=" + strings.Join(qosFields, ",")
+	// Limits of a QOS, by sacctmgr field
+	qosLimits     = []string{"GrpJobs", "GrpSubmitJobs", "MaxJobsPerUser", "MaxSubmitJobsPerUser", "MaxWall"}
+	qosTRESLimits = []string{"GrpTRES", "MaxTRESPerUser", "MaxTRESPerJob"}
+)
+
+type QOSMetrics struct {
+	priority    float64
+	preemptMode string
+	// Limits which are set, by sacctmgr field and then TRES
+	limits     map[string]float64
+	tresLimits map[string]map[string]float64
+	// Usage of the running and pending jobs, by state
+	jobs map[string]float64
+	tres map[string]map[string]float64
+	// TRES of the running jobs, by user
+	userTRES map[string]map[string]float64
+}
+
+// parseLimit reads the value of a limit printed by sacctmgr, which is empty
+// when it is not set.
+func parseLimit(field, value string) (float64, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if field == "MaxWall" {
+		return parseSlurmDuration(value)
+	}
+	v, err := strconv.ParseFloat(value, 64)
+	return v, err == nil
+}
+
+func (qc *QOSCollector) QOSGetMetrics(ctx context.Context) map[string]*QOSMetrics {
+	qos := make(map[string]*QOSMetrics)
+	out := getData(ctx, qc.isTest, qosCommand, qosTestData)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, "|")
+		if len(fields) < len(qosFields) {
+			continue
+		}
+		values := map[string]string{}
+		for i, field := range qosFields {
+			values[field] = fields[i]
+		}
+		qm := &QOSMetrics{
+			preemptMode: values["PreemptMode"],
+			limits:      map[string]float64{},
+			tresLimits:  map[string]map[string]float64{},
+			jobs:        map[string]float64{},
+			tres:        map[string]map[string]float64{},
+			userTRES:    map[string]map[string]float64{},
+		}
+		qm.priority, _ = strconv.ParseFloat(values["Priority"], 64)
+		for _, field := range qosLimits {
+			if v, ok := parseLimit(field, values[field]); ok {
+				qm.limits[field] = v
+			}
+		}
+		for _, field := range qosTRESLimits {
+			if values[field] != "" {
+				qm.tresLimits[field] = parseTRES(values[field])
+			}
+		}
+		qos[values["Name"]] = qm
+	}
+
+	for _, job := range getJobs(ctx, qc.isTest).Jobs {
+		qm, ok := qos[job.Qos]
+		if !ok {
+			continue
+		}
+		switch job.JobState {
+		case "RUNNING":
+			tres := parseTRES(job.TresAllocStr)
+			qm.jobs["running"]++
+			addTRES(qm.tres, "running", tres)
+			if _, ok := qm.tresLimits["MaxTRESPerUser"]; ok {
+				addTRES(qm.userTRES, job.UserName, tres)
+			}
+		case "PENDING":
+			qm.jobs["pending"]++
+			addTRES(qm.tres, "pending", parseTRES(job.TresReqStr))
+		}
+	}
+	return qos
+}
+
+/*
+ * Implement the Prometheus Collector interface and feed the
+ * Slurm QOS configuration and usage into it.
+ * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
+ */
+
+type QOSCollector struct {
+	isTest       bool
+	info         *prometheus.Desc
+	priority     *prometheus.Desc
+	limits       map[string]*prometheus.Desc
+	tresLimits   map[string]*prometheus.Desc
+	jobs         *prometheus.Desc
+	tres         *prometheus.Desc
+	userTRES     *prometheus.Desc
+	tresHeadroom *prometheus.Desc
+}
+
+func NewQOSCollector(isTest bool) *QOSCollector {
+	labels := []string{"qos"}
+	tresLabels := []string{"qos", "tres"}
+	return &QOSCollector{
+		isTest:   isTest,
+		info:     prometheus.NewDesc("slurm_qos_info", "Information about the QOS", []string{"qos", "preempt_mode"}, nil),
+		priority: prometheus.NewDesc("slurm_qos_priority", "Priority of the QOS", labels, nil),
+		limits: map[string]*prometheus.Desc{
+			"GrpJobs":              prometheus.NewDesc("slurm_qos_grp_jobs_limit", "Maximum running jobs in the QOS", labels, nil),
+			"GrpSubmitJobs":        prometheus.NewDesc("slurm_qos_grp_submit_jobs_limit", "Maximum running and pending jobs in the QOS", labels, nil),
+			"MaxJobsPerUser":       prometheus.NewDesc("slurm_qos_max_jobs_per_user_limit", "Maximum running jobs per user in the QOS", labels, nil),
+			"MaxSubmitJobsPerUser": prometheus.NewDesc("slurm_qos_max_submit_jobs_per_user_limit", "Maximum running and pending jobs per user in the QOS", labels, nil),
+			"MaxWall":              prometheus.NewDesc("slurm_qos_max_wall_seconds", "Maximum run time of the jobs in the QOS", labels, nil),
+		},
+		tresLimits: map[string]*prometheus.Desc{
+			"GrpTRES":        prometheus.NewDesc("slurm_qos_grp_tres_limit", "Maximum TRES used by the running jobs of the QOS, memory in bytes", tresLabels, nil),
+			"MaxTRESPerUser": prometheus.NewDesc("slurm_qos_max_tres_per_user_limit", "Maximum TRES used by the running jobs of a user in the QOS, memory in bytes", tresLabels, nil),
+			"MaxTRESPerJob":  prometheus.NewDesc("slurm_qos_max_tres_per_job_limit", "Maximum TRES of a job in the QOS, memory in bytes", tresLabels, nil),
+		},
+		jobs:         prometheus.NewDesc("slurm_qos_jobs", "Running and pending jobs in the QOS", []string{"qos", "state"}, nil),
+		tres:         prometheus.NewDesc("slurm_qos_tres", "TRES allocated to the running jobs and requested by the pending jobs of the QOS, memory in bytes", []string{"qos", "state", "tres"}, nil),
+		userTRES:     prometheus.NewDesc("slurm_qos_user_tres_used", "TRES allocated to the running jobs of a user in a QOS limiting them, memory in bytes", []string{"qos", "user", "tres"}, nil),
+		tresHeadroom: prometheus.NewDesc("slurm_qos_grp_tres_headroom", "TRES still available to the running jobs of the QOS before reaching GrpTRES, memory in bytes", tresLabels, nil),
+	}
+}
+
+func (qc *QOSCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- qc.info
+	ch <- qc.priority
+	for _, field := range qosLimits {
+		ch <- qc.limits[field]
+	}
+	for _, field := range qosTRESLimits {
+		ch <- qc.tresLimits[field]
+	}
+	ch <- qc.jobs
+	ch <- qc.tres
+	ch <- qc.userTRES
+	ch <- qc.tresHeadroom
+}
+
+func (qc *QOSCollector) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	qm := qc.QOSGetMetrics(ctx)
+	for q := range qm {
+		ch <- prometheus.MustNewConstMetric(qc.info, prometheus.GaugeValue, 1, q, qm[q].preemptMode)
+		ch <- prometheus.MustNewConstMetric(qc.priority, prometheus.GaugeValue, qm[q].priority, q)
+		for field, value := range qm[q].limits {
+			ch <- prometheus.MustNewConstMetric(qc.limits[field], prometheus.GaugeValue, value, q)
+		}
+		for field, limits := range qm[q].tresLimits {
+			for tres, value := range limits {
+				ch <- prometheus.MustNewConstMetric(qc.tresLimits[field], prometheus.GaugeValue, value, q, tres)
+			}
+		}
+		for tres, value := range qm[q].tresLimits["GrpTRES"] {
+			used := qm[q].tres["running"][tres]
+			ch <- prometheus.MustNewConstMetric(qc.tresHeadroom, prometheus.GaugeValue, value-used, q, tres)
+		}
+		for state, value := range qm[q].jobs {
+			ch <- prometheus.MustNewConstMetric(qc.jobs, prometheus.GaugeValue, value, q, state)
+		}
+		for state, tres := range qm[q].tres {
+			for name, value := range tres {
+				ch <- prometheus.MustNewConstMetric(qc.tres, prometheus.GaugeValue, value, q, state, name)
+			}
+		}
+		for user, tres := range qm[q].userTRES {
+			for name, value := range tres {
+				ch <- prometheus.MustNewConstMetric(qc.userTRES, prometheus.GaugeValue, value, q, user, name)
+			}
+		}
+	}
+}
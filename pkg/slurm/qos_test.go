@@ -0,0 +1,31 @@
+// SPDX-FileCopyrightText: 2022 2022 Marshall Wace <opensource@mwam.com>
+//
+// SPDX-License-Identifier: GPL3
+
+package slurm
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQOSGetMetrics(t *testing.T) {
+	collector := NewQOSCollector(true)
+	qm := collector.QOSGetMetrics(context.Background())
+	assert.Len(t, qm, 2)
+
+	high := qm["high"]
+	assert.Equal(t, 100.0, high.priority)
+	assert.Equal(t, "requeue", high.preemptMode)
+	assert.Equal(t, map[string]float64{"GrpJobs": 10, "GrpSubmitJobs": 20, "MaxJobsPerUser": 2, "MaxSubmitJobsPerUser": 4, "MaxWall": 86400}, high.limits)
+	assert.Equal(t, 256.0*gibibyte, high.tresLimits["GrpTRES"]["mem"])
+	assert.Equal(t, map[string]float64{"running": 1, "pending": 1}, high.jobs)
+	assert.Equal(t, 2.0, high.tres["running"]["gres/gpu"])
+
+	normal := qm["normal"]
+	assert.Empty(t, normal.limits)
+	assert.Equal(t, 64.0, normal.tresLimits["MaxTRESPerUser"]["cpu"])
+	assert.Equal(t, 4.0, normal.userTRES["alice"]["cpu"])
+}
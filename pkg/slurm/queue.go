@@ -3,16 +3,168 @@
 package slurm
 
 import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
 	"strings"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 const (
-	queueCommand  = "squeue -a -r -h -o %A,%T,%r --states=all"
+	queueCommand  = "squeue -a -r -h -o %i,%T,%r --states=all"
 	queueTestData = "./test_data/squeue.txt"
 )
 
+// defaultReasonCategories maps the reasons of pending jobs to the categories
+// of slurm_jobs_pending_category. A trailing `*` matches any reason starting
+// with what precedes it, the longest match wins. Reasons matching nothing are
+// in the `other` category.
+var defaultReasonCategories = map[string]string{
+	"Resources":                "resources",
+	"Nodes*":                   "resources",
+	"ReqNodeNotAvail*":         "resources",
+	"NodeDown":                 "resources",
+	"PartitionDown":            "resources",
+	"PartitionInactive":        "resources",
+	"Licenses":                 "resources",
+	"BurstBufferResources":     "resources",
+	"Priority":                 "priority",
+	"Assoc*":                   "limits",
+	"QOS*":                     "limits",
+	"MaxCpuPerAccount":         "limits",
+	"PartitionTimeLimit":       "limits",
+	"PartitionNodeLimit":       "limits",
+	"JobArrayTaskLimit":        "limits",
+	"Dependency":               "dependency",
+	"DependencyNeverSatisfied": "dependency",
+	"JobHeld*":                 "held",
+	"BeginTime":                "held",
+	"Reservation":              "reservation",
+	"ReservationDeleted":       "reservation",
+	"ResvDeleted":              "reservation",
+}
+
+// loadReasonCategories returns the default categories overridden by the
+// `Reason=category` lines of path, if any. Empty lines and lines starting
+// with # are ignored.
+func loadReasonCategories(path string) (map[string]string, error) {
+	categories := make(map[string]string, len(defaultReasonCategories))
+	for reason, category := range defaultReasonCategories {
+		categories[reason] = category
+	}
+	if path == "" {
+		return categories, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || strings.TrimSpace(kv[1]) == "" {
+			return nil, fmt.Errorf("%s:%d: expected Reason=category, got %q", path, n, line)
+		}
+		categories[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return categories, scanner.Err()
+}
+
+// reasonCategory returns the category of a pending reason.
+func reasonCategory(categories map[string]string, reason string) string {
+	if category, ok := categories[reason]; ok {
+		return category
+	}
+	category, longest := "other", -1
+	for pattern, c := range categories {
+		prefix := strings.TrimSuffix(pattern, "*")
+		if prefix == pattern || !strings.HasPrefix(reason, prefix) || len(prefix) <= longest {
+			continue
+		}
+		category, longest = c, len(prefix)
+	}
+	return category
+}
+
+// hetJobComponent tells whether a job ID printed by squeue with %i, e.g.
+// `1020+1`, is a component of a heterogeneous job other than the first one.
+// squeue lists every component, they make up a single job though.
+func hetJobComponent(id string) bool {
+	i := strings.Index(id, "+")
+	return i >= 0 && id[i+1:] != "0"
+}
+
+type pendingKey struct {
+	partition string
+	account   string
+	qos       string
+	reason    string
+}
+
+// QueuePendingMetrics counts the pending jobs by partition, account, QOS and
+// reason, and by category of reason in place of the reason.
+func (qc *QueueCollector) QueuePendingMetrics(ctx context.Context) (reasons map[pendingKey]float64, categories map[pendingKey]float64) {
+	reasons = make(map[pendingKey]float64)
+	categories = make(map[pendingKey]float64)
+	for _, job := range getJobs(ctx, qc.isTest).Jobs {
+		if job.JobState != "PENDING" || job.HetJobOffset > 0 {
+			continue
+		}
+		key := pendingKey{job.Partition, job.Account, job.Qos, job.StateReason}
+		reasons[key]++
+		key.reason = reasonCategory(qc.reasonCategories, job.StateReason)
+		categories[key]++
+	}
+	return reasons, categories
+}
+
+// parseDependencyTypes returns the types of the dependencies of a job, e.g.
+// afterok and singleton for `afterok:123(unfulfilled),singleton(unfulfilled)`.
+// All of the dependencies are separated by `,`, any of them by `?`.
+func parseDependencyTypes(dependency string) []string {
+	var types []string
+	seen := make(map[string]bool)
+	for _, d := range strings.FieldsFunc(dependency, func(r rune) bool { return r == ',' || r == '?' }) {
+		fields := strings.FieldsFunc(d, func(r rune) bool { return r == ':' || r == '(' })
+		if len(fields) == 0 {
+			continue
+		}
+		t := strings.ToLower(strings.TrimSpace(fields[0]))
+		if t == "" || seen[t] {
+			continue
+		}
+		seen[t] = true
+		types = append(types, t)
+	}
+	return types
+}
+
+// QueueDependencyMetrics counts the jobs by type of dependency, and the
+// jobs whose dependencies can never be satisfied by account.
+func (qc *QueueCollector) QueueDependencyMetrics(ctx context.Context) (types map[string]float64, neverSatisfied map[string]float64) {
+	types = make(map[string]float64)
+	neverSatisfied = make(map[string]float64)
+	for _, job := range getJobs(ctx, qc.isTest).Jobs {
+		if job.HetJobOffset > 0 {
+			continue
+		}
+		for _, t := range parseDependencyTypes(job.Dependency) {
+			types[t]++
+		}
+		if job.StateReason == "DependencyNeverSatisfied" {
+			neverSatisfied[job.Account]++
+		}
+	}
+	return types, neverSatisfied
+}
+
 type QueueMetrics struct {
 	pending       float64
 	pending_dep   float64
@@ -29,14 +181,17 @@ type QueueMetrics struct {
 	out_of_memory float64
 }
 
-func (qc *QueueCollector) QueueGetMetrics() *QueueMetrics {
-	data := getData(qc.isTest, queueCommand, queueTestData)
+func (qc *QueueCollector) QueueGetMetrics(ctx context.Context) *QueueMetrics {
+	data := getData(ctx, qc.isTest, queueCommand, queueTestData)
 
 	var qm QueueMetrics
 	lines := strings.Split(data, "\n")
 	for _, line := range lines {
 		if strings.Contains(line, ",") {
 			splitted := strings.Split(line, ",")
+			if hetJobComponent(splitted[0]) {
+				continue
+			}
 			state := splitted[1]
 			switch state {
 			case "PENDING":
@@ -78,40 +233,51 @@ func (qc *QueueCollector) QueueGetMetrics() *QueueMetrics {
  * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
  */
 
-func NewQueueCollector(isTest bool) *QueueCollector {
+func NewQueueCollector(isTest bool, reasonCategories map[string]string) *QueueCollector {
+	labels := []string{"partition", "account", "qos"}
 	return &QueueCollector{
-		isTest:        isTest,
-		pending:       prometheus.NewDesc("slurm_queue_pending", "Pending jobs in queue", nil, nil),
-		pending_dep:   prometheus.NewDesc("slurm_queue_pending_dependency", "Pending jobs because of dependency in queue", nil, nil),
-		running:       prometheus.NewDesc("slurm_queue_running", "Running jobs in the cluster", nil, nil),
-		suspended:     prometheus.NewDesc("slurm_queue_suspended", "Suspended jobs in the cluster", nil, nil),
-		cancelled:     prometheus.NewDesc("slurm_queue_cancelled", "Cancelled jobs in the cluster", nil, nil),
-		completing:    prometheus.NewDesc("slurm_queue_completing", "Completing jobs in the cluster", nil, nil),
-		completed:     prometheus.NewDesc("slurm_queue_completed", "Completed jobs in the cluster", nil, nil),
-		configuring:   prometheus.NewDesc("slurm_queue_configuring", "Configuring jobs in the cluster", nil, nil),
-		failed:        prometheus.NewDesc("slurm_queue_failed", "Number of failed jobs", nil, nil),
-		timeout:       prometheus.NewDesc("slurm_queue_timeout", "Jobs stopped by timeout", nil, nil),
-		preempted:     prometheus.NewDesc("slurm_queue_preempted", "Number of preempted jobs", nil, nil),
-		node_fail:     prometheus.NewDesc("slurm_queue_node_fail", "Number of jobs stopped due to node fail", nil, nil),
-		out_of_memory: prometheus.NewDesc("slurm_queue_out_of_memory", "Number of jobs stopped by oomkiller", nil, nil),
+		isTest:           isTest,
+		reasonCategories: reasonCategories,
+		jobsPending:      prometheus.NewDesc("slurm_jobs_pending", "Pending jobs by reason", append(labels, "reason"), nil),
+		jobsPendingCat:   prometheus.NewDesc("slurm_jobs_pending_category", "Pending jobs by category of reason", append(labels, "category"), nil),
+		dependencies:     prometheus.NewDesc("slurm_jobs_dependency", "Jobs with a dependency of the type", []string{"type"}, nil),
+		neverSatisfied:   prometheus.NewDesc("slurm_jobs_dependency_never_satisfied", "Pending jobs whose dependencies can never be satisfied", []string{"account"}, nil),
+		pending:          prometheus.NewDesc("slurm_queue_pending", "Pending jobs in queue", nil, nil),
+		pending_dep:      prometheus.NewDesc("slurm_queue_pending_dependency", "Pending jobs because of dependency in queue", nil, nil),
+		running:          prometheus.NewDesc("slurm_queue_running", "Running jobs in the cluster", nil, nil),
+		suspended:        prometheus.NewDesc("slurm_queue_suspended", "Suspended jobs in the cluster", nil, nil),
+		cancelled:        prometheus.NewDesc("slurm_queue_cancelled", "Cancelled jobs in the cluster", nil, nil),
+		completing:       prometheus.NewDesc("slurm_queue_completing", "Completing jobs in the cluster", nil, nil),
+		completed:        prometheus.NewDesc("slurm_queue_completed", "Completed jobs in the cluster", nil, nil),
+		configuring:      prometheus.NewDesc("slurm_queue_configuring", "Configuring jobs in the cluster", nil, nil),
+		failed:           prometheus.NewDesc("slurm_queue_failed", "Number of failed jobs", nil, nil),
+		timeout:          prometheus.NewDesc("slurm_queue_timeout", "Jobs stopped by timeout", nil, nil),
+		preempted:        prometheus.NewDesc("slurm_queue_preempted", "Number of preempted jobs", nil, nil),
+		node_fail:        prometheus.NewDesc("slurm_queue_node_fail", "Number of jobs stopped due to node fail", nil, nil),
+		out_of_memory:    prometheus.NewDesc("slurm_queue_out_of_memory", "Number of jobs stopped by oomkiller", nil, nil),
 	}
 }
 
 type QueueCollector struct {
-	isTest        bool
-	pending       *prometheus.Desc
-	pending_dep   *prometheus.Desc
-	running       *prometheus.Desc
-	suspended     *prometheus.Desc
-	cancelled     *prometheus.Desc
-	completing    *prometheus.Desc
-	completed     *prometheus.Desc
-	configuring   *prometheus.Desc
-	failed        *prometheus.Desc
-	timeout       *prometheus.Desc
-	preempted     *prometheus.Desc
-	node_fail     *prometheus.Desc
-	out_of_memory *prometheus.Desc
+	isTest           bool
+	reasonCategories map[string]string
+	jobsPending      *prometheus.Desc
+	jobsPendingCat   *prometheus.Desc
+	dependencies     *prometheus.Desc
+	neverSatisfied   *prometheus.Desc
+	pending          *prometheus.Desc
+	pending_dep      *prometheus.Desc
+	running          *prometheus.Desc
+	suspended        *prometheus.Desc
+	cancelled        *prometheus.Desc
+	completing       *prometheus.Desc
+	completed        *prometheus.Desc
+	configuring      *prometheus.Desc
+	failed           *prometheus.Desc
+	timeout          *prometheus.Desc
+	preempted        *prometheus.Desc
+	node_fail        *prometheus.Desc
+	out_of_memory    *prometheus.Desc
 }
 
 func (qc *QueueCollector) Describe(ch chan<- *prometheus.Desc) {
@@ -128,10 +294,14 @@ func (qc *QueueCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- qc.preempted
 	ch <- qc.node_fail
 	ch <- qc.out_of_memory
+	ch <- qc.jobsPending
+	ch <- qc.jobsPendingCat
+	ch <- qc.dependencies
+	ch <- qc.neverSatisfied
 }
 
-func (qc *QueueCollector) Collect(ch chan<- prometheus.Metric) {
-	qm := qc.QueueGetMetrics()
+func (qc *QueueCollector) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	qm := qc.QueueGetMetrics(ctx)
 	ch <- prometheus.MustNewConstMetric(qc.pending, prometheus.GaugeValue, qm.pending)
 	ch <- prometheus.MustNewConstMetric(qc.pending_dep, prometheus.GaugeValue, qm.pending_dep)
 	ch <- prometheus.MustNewConstMetric(qc.running, prometheus.GaugeValue, qm.running)
@@ -145,4 +315,18 @@ func (qc *QueueCollector) Collect(ch chan<- prometheus.Metric) {
 	ch <- prometheus.MustNewConstMetric(qc.preempted, prometheus.GaugeValue, qm.preempted)
 	ch <- prometheus.MustNewConstMetric(qc.node_fail, prometheus.GaugeValue, qm.node_fail)
 	ch <- prometheus.MustNewConstMetric(qc.out_of_memory, prometheus.GaugeValue, qm.out_of_memory)
+	reasons, categories := qc.QueuePendingMetrics(ctx)
+	for k, v := range reasons {
+		ch <- prometheus.MustNewConstMetric(qc.jobsPending, prometheus.GaugeValue, v, k.partition, k.account, k.qos, k.reason)
+	}
+	for k, v := range categories {
+		ch <- prometheus.MustNewConstMetric(qc.jobsPendingCat, prometheus.GaugeValue, v, k.partition, k.account, k.qos, k.reason)
+	}
+	types, neverSatisfied := qc.QueueDependencyMetrics(ctx)
+	for t, v := range types {
+		ch <- prometheus.MustNewConstMetric(qc.dependencies, prometheus.GaugeValue, v, t)
+	}
+	for account, v := range neverSatisfied {
+		ch <- prometheus.MustNewConstMetric(qc.neverSatisfied, prometheus.GaugeValue, v, account)
+	}
 }
@@ -3,10 +3,70 @@
 package slurm
 
 import (
+	"context"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestQueueGetMetrics(t *testing.T) {
-	collector := NewQueueCollector(true)
-	t.Logf("%+v", collector.QueueGetMetrics())
+	collector := NewQueueCollector(true, defaultReasonCategories)
+	qm := collector.QueueGetMetrics(context.Background())
+	t.Logf("%+v", qm)
+	// Both components of the heterogeneous job 1020 make up one job
+	assert.Equal(t, 29.0, qm.running)
+	assert.Equal(t, 4.0, qm.pending)
+}
+
+func TestHetJobComponent(t *testing.T) {
+	assert.False(t, hetJobComponent("1020+0"))
+	assert.True(t, hetJobComponent("1020+1"))
+	assert.False(t, hetJobComponent("1010_3"))
+	assert.False(t, hetJobComponent("1001"))
+}
+
+func TestQueuePendingMetrics(t *testing.T) {
+	collector := NewQueueCollector(true, defaultReasonCategories)
+	reasons, categories := collector.QueuePendingMetrics(context.Background())
+	assert.Len(t, reasons, 6)
+	assert.Equal(t, 1.0, reasons[pendingKey{"gpu", "chemistry", "high", "Resources"}])
+	assert.Equal(t, map[pendingKey]float64{
+		{"compute", "physics", "normal", "priority"}:   1,
+		{"compute", "physics", "normal", "limits"}:     1,
+		{"compute", "physics", "normal", "resources"}:  1,
+		{"compute", "biology", "normal", "dependency"}: 2,
+		{"gpu", "chemistry", "high", "resources"}:      1,
+	}, categories)
+}
+
+func TestReasonCategory(t *testing.T) {
+	assert.Equal(t, "limits", reasonCategory(defaultReasonCategories, "AssocGrpCpuLimit"))
+	assert.Equal(t, "resources", reasonCategory(defaultReasonCategories, "ReqNodeNotAvail, UnavailableNodes:n004"))
+	assert.Equal(t, "held", reasonCategory(defaultReasonCategories, "JobHeldAdmin"))
+	assert.Equal(t, "other", reasonCategory(defaultReasonCategories, "InvalidAccount"))
+
+	categories, err := loadReasonCategories("test_data/pending_reasons.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "limits", reasonCategory(categories, "Licenses"))
+	// The exact reason wins over the QOS* default
+	assert.Equal(t, "user-limits", reasonCategory(categories, "QOSMaxCpuPerUserLimit"))
+	assert.Equal(t, "limits", reasonCategory(categories, "QOSGrpCpuLimit"))
+
+	_, err = loadReasonCategories("test_data/squeue.txt")
+	assert.Error(t, err)
+}
+
+func TestParseDependencyTypes(t *testing.T) {
+	assert.Equal(t, []string{"afterok", "singleton"}, parseDependencyTypes("afterok:999(failed),singleton(unfulfilled)"))
+	assert.Equal(t, []string{"afterany", "afternotok"}, parseDependencyTypes("afterany:1:2(unfulfilled)?afternotok:3(unfulfilled)"))
+	assert.Equal(t, []string{"aftercorr"}, parseDependencyTypes("aftercorr:4(unfulfilled),aftercorr:5(unfulfilled)"))
+	assert.Empty(t, parseDependencyTypes(""))
+	assert.Empty(t, parseDependencyTypes(",(:"))
+}
+
+func TestQueueDependencyMetrics(t *testing.T) {
+	collector := NewQueueCollector(true, defaultReasonCategories)
+	types, neverSatisfied := collector.QueueDependencyMetrics(context.Background())
+	assert.Equal(t, map[string]float64{"afterok": 2, "singleton": 1}, types)
+	assert.Equal(t, map[string]float64{"biology": 1}, neverSatisfied)
 }
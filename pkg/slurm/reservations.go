@@ -0,0 +1,112 @@
+// SPDX-FileCopyrightText: 2022 2022 Marshall Wace <opensource@mwam.com>
+//
+// SPDX-License-Identifier: GPL3
+
+package slurm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	reservationsCommand  = "scontrol show reservation --json"
+	reservationsTestData = "test_data/reservations.json"
+)
+
+type ReservationsOutput struct {
+	Reservations []struct {
+		Accounts  string      `json:"accounts"`
+		CoreCount slurmNumber `json:"core_count"`
+		EndTime   slurmNumber `json:"end_time"`
+		Flags     []string    `json:"flags"`
+		Name      string      `json:"name"`
+		NodeCount slurmNumber `json:"node_count"`
+		NodeList  string      `json:"node_list"`
+		Partition string      `json:"partition"`
+		StartTime slurmNumber `json:"start_time"`
+		Users     string      `json:"users"`
+	} `json:"reservations"`
+}
+
+/*
+ * Implement the Prometheus Collector interface and feed the
+ * Slurm reservations into it.
+ * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
+ */
+
+type ReservationsCollector struct {
+	isTest    bool
+	info      *prometheus.Desc
+	startTime *prometheus.Desc
+	endTime   *prometheus.Desc
+	nodes     *prometheus.Desc
+	cores     *prometheus.Desc
+	cpusUsed  *prometheus.Desc
+}
+
+func NewReservationsCollector(isTest bool) *ReservationsCollector {
+	labels := []string{"reservation"}
+	return &ReservationsCollector{
+		isTest:    isTest,
+		info:      prometheus.NewDesc("slurm_reservation_info", "Information about reservations", []string{"reservation", "partition", "nodes", "flags", "users", "accounts"}, nil),
+		startTime: prometheus.NewDesc("slurm_reservation_start_time_seconds", "Start time of the reservation since epoch", labels, nil),
+		endTime:   prometheus.NewDesc("slurm_reservation_end_time_seconds", "End time of the reservation since epoch", labels, nil),
+		nodes:     prometheus.NewDesc("slurm_reservation_nodes", "Nodes in the reservation", labels, nil),
+		cores:     prometheus.NewDesc("slurm_reservation_cores", "Cores in the reservation", labels, nil),
+		cpusUsed:  prometheus.NewDesc("slurm_reservation_cpus_used", "CPUs of the reservation used by running jobs", labels, nil),
+	}
+}
+
+func (rc *ReservationsCollector) getReservations(ctx context.Context) *ReservationsOutput {
+	data := getData(ctx, rc.isTest, reservationsCommand, reservationsTestData)
+	reservations := &ReservationsOutput{}
+	err := json.Unmarshal([]byte(data), reservations)
+	if err != nil {
+		ExporterErrors.WithLabelValues("json-encoding-reservations", err.Error()).Inc()
+		fmt.Println(err)
+	}
+	return reservations
+}
+
+func (rc *ReservationsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- rc.info
+	ch <- rc.startTime
+	ch <- rc.endTime
+	ch <- rc.nodes
+	ch <- rc.cores
+	ch <- rc.cpusUsed
+}
+
+func (rc *ReservationsCollector) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	reservations := rc.getReservations(ctx)
+	if len(reservations.Reservations) == 0 {
+		return
+	}
+	cpusUsed := make(map[string]float64)
+	for _, job := range getJobs(ctx, rc.isTest).Jobs {
+		if job.ResvName != "" && job.JobState == "RUNNING" {
+			cpusUsed[job.ResvName] += float64(job.Cpus)
+		}
+	}
+	for _, r := range reservations.Reservations {
+		ch <- prometheus.MustNewConstMetric(rc.info, prometheus.GaugeValue, 1, r.Name, r.Partition, r.NodeList, strings.Join(r.Flags, ","), r.Users, r.Accounts)
+		if v, ok := r.StartTime.Float(); ok {
+			ch <- prometheus.MustNewConstMetric(rc.startTime, prometheus.GaugeValue, v, r.Name)
+		}
+		if v, ok := r.EndTime.Float(); ok {
+			ch <- prometheus.MustNewConstMetric(rc.endTime, prometheus.GaugeValue, v, r.Name)
+		}
+		if v, ok := r.NodeCount.Float(); ok {
+			ch <- prometheus.MustNewConstMetric(rc.nodes, prometheus.GaugeValue, v, r.Name)
+		}
+		if v, ok := r.CoreCount.Float(); ok {
+			ch <- prometheus.MustNewConstMetric(rc.cores, prometheus.GaugeValue, v, r.Name)
+		}
+		ch <- prometheus.MustNewConstMetric(rc.cpusUsed, prometheus.GaugeValue, cpusUsed[r.Name], r.Name)
+	}
+}
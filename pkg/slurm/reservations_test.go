@@ -0,0 +1,34 @@
+// SPDX-FileCopyrightText: 2022 2022 Marshall Wace <opensource@mwam.com>
+//
+// SPDX-License-Identifier: GPL3
+
+package slurm
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReservationsMetrics(t *testing.T) {
+	collector := NewReservationsCollector(true)
+	reservations := collector.getReservations(context.Background())
+	assert.Len(t, reservations.Reservations, 2)
+	start, ok := reservations.Reservations[0].StartTime.Float()
+	assert.True(t, ok)
+	assert.Equal(t, 1664611200.0, start)
+
+	// 2 reservations with 6 metrics each
+	c := &scrapeCollector{ctx: context.Background(), collector: collector}
+	assert.Equal(t, 12, testutil.CollectAndCount(c))
+	expected := `
+# HELP slurm_reservation_cpus_used CPUs of the reservation used by running jobs
+# TYPE slurm_reservation_cpus_used gauge
+slurm_reservation_cpus_used{reservation="chemistry_project"} 0
+slurm_reservation_cpus_used{reservation="maint"} 16
+`
+	assert.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(expected), "slurm_reservation_cpus_used"))
+}
@@ -0,0 +1,236 @@
+// SPDX-FileCopyrightText: 2022 2022 Marshall Wace <opensource@mwam.com>
+//
+// SPDX-License-Identifier: GPL3
+
+package slurm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	finishedJobsCommand   = "sacct -a -X -n -P --state=BF,CA,CD,DL,F,NF,OOM,PR,TO -o JobID,Partition,Account,QOS,State,Submit,Start,End"
+	finishedJobsTestData  = "test_data/sacct_finished.txt"
+	finishedJobsStateFile = "finished_jobs.json"
+
+	sacctTimeFormat = "2006-01-02T15:04:05"
+	// sacctOverlap is how far before the watermark every sacct query starts,
+	// so that jobs reaching slurmdbd late are still accounted for.
+	sacctOverlap = 10 * time.Minute
+)
+
+var (
+	finishedJobsLabels = []string{"partition", "account", "qos"}
+)
+
+// sacctWindow remembers which finished jobs a collector already accounted for,
+// so that the overlapping sacct queries of consecutive scrapes never count a job
+// twice. It is persisted to a state file to survive restarts.
+type sacctWindow struct {
+	// Watermark is the end time of the most recent job seen
+	Watermark int64 `json:"watermark"`
+	// Seen holds the end time of the jobs which may still be returned by the
+	// next query
+	Seen map[string]int64 `json:"seen"`
+	path string
+}
+
+// loadSacctWindow reads the window persisted at path, if any. An empty path
+// keeps the window in memory only.
+func loadSacctWindow(path string) *sacctWindow {
+	w := &sacctWindow{Seen: map[string]int64{}, path: path}
+	if path == "" {
+		return w
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			ExporterErrors.WithLabelValues("sacct-state-read", err.Error()).Inc()
+			fmt.Println(err)
+		}
+		return w
+	}
+	err = json.Unmarshal(data, w)
+	if err != nil {
+		ExporterErrors.WithLabelValues("sacct-state-read", err.Error()).Inc()
+		fmt.Println(err)
+		return &sacctWindow{Seen: map[string]int64{}, path: path}
+	}
+	if w.Seen == nil {
+		w.Seen = map[string]int64{}
+	}
+	return w
+}
+
+// start returns the beginning of the next query. On the very first run there
+// is nothing to query: only jobs finishing from now on are accounted for.
+func (w *sacctWindow) start(now time.Time) (time.Time, bool) {
+	if w.Watermark == 0 {
+		w.Watermark = now.Unix()
+		return now, false
+	}
+	return time.Unix(w.Watermark, 0).Add(-sacctOverlap), true
+}
+
+// add records a finished job and reports whether it is new.
+func (w *sacctWindow) add(jobID string, end time.Time) bool {
+	if _, ok := w.Seen[jobID]; ok {
+		return false
+	}
+	w.Seen[jobID] = end.Unix()
+	if end.Unix() > w.Watermark {
+		w.Watermark = end.Unix()
+	}
+	return true
+}
+
+// save forgets the jobs which can no longer be returned and persists the
+// window.
+func (w *sacctWindow) save() {
+	oldest := time.Unix(w.Watermark, 0).Add(-sacctOverlap - time.Minute).Unix()
+	for id, end := range w.Seen {
+		if end < oldest {
+			delete(w.Seen, id)
+		}
+	}
+	if w.path == "" {
+		return
+	}
+	data, err := json.Marshal(w)
+	if err == nil {
+		// Write then rename so that a crash never leaves a truncated file
+		tmp := w.path + ".tmp"
+		err = ioutil.WriteFile(tmp, data, 0644)
+		if err == nil {
+			err = os.Rename(tmp, w.path)
+		}
+	}
+	if err != nil {
+		ExporterErrors.WithLabelValues("sacct-state-write", err.Error()).Inc()
+		fmt.Println(err)
+	}
+}
+
+// parseSacctTime parses the timestamps printed by sacct, which are in local
+// time. Jobs which never started print `Unknown` or `None`.
+func parseSacctTime(value string) (time.Time, bool) {
+	t, err := time.ParseInLocation(sacctTimeFormat, value, time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+type finishedJobsCollector struct {
+	finished     *prometheus.CounterVec
+	runDuration  *prometheus.HistogramVec
+	waitDuration *prometheus.HistogramVec
+	isTest       bool
+	now          func() time.Time
+	// mu serialises the scrapes, each of them moves the window
+	mu     sync.Mutex
+	window *sacctWindow
+}
+
+// NewFinishedJobsCollector returns a collector accounting for the jobs which
+// finished since its previous scrape, keeping its window in stateDir when set.
+func NewFinishedJobsCollector(isTest bool, stateDir string) *finishedJobsCollector {
+	path := ""
+	if stateDir != "" {
+		path = filepath.Join(stateDir, finishedJobsStateFile)
+	}
+	return &finishedJobsCollector{
+		isTest: isTest,
+		now:    time.Now,
+		window: loadSacctWindow(path),
+		finished: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Subsystem: "",
+				Name:      "slurm_jobs_finished_total",
+				Help:      "Jobs which finished, by final state, as reported by sacct.",
+			}, append(finishedJobsLabels, "state")),
+		runDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Subsystem: "",
+				Name:      "slurm_job_run_duration_seconds",
+				Help:      "Run time of the jobs which finished, as reported by sacct.",
+				Buckets:   durationBuckets,
+			}, finishedJobsLabels),
+		waitDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Subsystem: "",
+				Name:      "slurm_job_wait_duration_seconds",
+				Help:      "Time spent pending by the jobs which finished, as reported by sacct.",
+				Buckets:   durationBuckets,
+			}, finishedJobsLabels),
+	}
+}
+
+func (s *finishedJobsCollector) getFinishedJobsMetrics(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	start, ok := s.window.start(now)
+	if !ok {
+		s.window.save()
+		return
+	}
+	var data string
+	if s.isTest {
+		data = readFile(finishedJobsTestData)
+	} else {
+		data = execCommandArgs(ctx, finishedJobsCommand, "-S", start.Format(sacctTimeFormat), "-E", now.Format(sacctTimeFormat))
+	}
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Split(line, "|")
+		if len(fields) < 8 {
+			continue
+		}
+		// e.g. `CANCELLED by 1234`
+		state := strings.Fields(fields[4])
+		if len(state) == 0 {
+			continue
+		}
+		// Jobs which ended before the window were accounted for by a
+		// previous scrape and may have been forgotten since
+		end, ok := parseSacctTime(fields[7])
+		if !ok || end.Before(start) || !s.window.add(fields[0], end) {
+			continue
+		}
+		labelValues := []string{fields[1], fields[2], fields[3]}
+		s.finished.WithLabelValues(append(labelValues, state[0])...).Inc()
+		submit, submitted := parseSacctTime(fields[5])
+		started, ok := parseSacctTime(fields[6])
+		if !ok {
+			continue
+		}
+		s.runDuration.WithLabelValues(labelValues...).Observe(end.Sub(started).Seconds())
+		if submitted {
+			s.waitDuration.WithLabelValues(labelValues...).Observe(started.Sub(submit).Seconds())
+		}
+	}
+	s.window.save()
+}
+
+func (s *finishedJobsCollector) Describe(ch chan<- *prometheus.Desc) {
+	s.finished.Describe(ch)
+	s.runDuration.Describe(ch)
+	s.waitDuration.Describe(ch)
+}
+
+func (s *finishedJobsCollector) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	s.getFinishedJobsMetrics(ctx)
+	s.finished.Collect(ch)
+	s.runDuration.Collect(ch)
+	s.waitDuration.Collect(ch)
+}
@@ -0,0 +1,49 @@
+// SPDX-FileCopyrightText: 2022 2022 Marshall Wace <opensource@mwam.com>
+//
+// SPDX-License-Identifier: GPL3
+
+package slurm
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFinishedJobsMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sacct")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	now, _ := parseSacctTime("2022-10-01T10:15:00")
+	collector := NewFinishedJobsCollector(true, dir)
+	collector.now = func() time.Time { return now }
+
+	// The first scrape only sets the watermark
+	collector.getFinishedJobsMetrics(context.Background())
+	assert.Equal(t, 0, testutil.CollectAndCount(collector.finished))
+
+	collector.window.Watermark = now.Add(-time.Hour).Unix()
+	collector.getFinishedJobsMetrics(context.Background())
+	assert.Equal(t, 1.0, testutil.ToFloat64(collector.finished.WithLabelValues("compute", "physics", "normal", "COMPLETED")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(collector.finished.WithLabelValues("compute", "physics", "normal", "CANCELLED")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(collector.finished.WithLabelValues("gpu", "chemistry", "high", "TIMEOUT")))
+	// 4243 ended before the watermark, within the overlap
+	assert.Equal(t, 1.0, testutil.ToFloat64(collector.finished.WithLabelValues("compute", "physics", "normal", "FAILED")))
+	// The jobs without a state are skipped
+	assert.Equal(t, 4, testutil.CollectAndCount(collector.finished))
+
+	// Jobs returned again by the next scrape, or after a restart, are not
+	// counted twice
+	collector.getFinishedJobsMetrics(context.Background())
+	restarted := NewFinishedJobsCollector(true, dir)
+	restarted.now = collector.now
+	restarted.getFinishedJobsMetrics(context.Background())
+	assert.Equal(t, 1.0, testutil.ToFloat64(collector.finished.WithLabelValues("compute", "physics", "normal", "COMPLETED")))
+	assert.Equal(t, 0, testutil.CollectAndCount(restarted.finished))
+}
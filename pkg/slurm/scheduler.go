@@ -3,99 +3,186 @@
 package slurm
 
 import (
-	"regexp"
-	"strconv"
-	"strings"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 const (
-	schedulerCommand  = "sdiag"
-	schedulerTestData = "test_data/sdiag.txt"
+	schedulerCommand  = "sdiag --json"
+	schedulerTestData = "test_data/sdiag.json"
 )
 
-/*
- * Execute the Slurm sdiag command to read the current statistics
- * from the Slurm scheduler. It will be repreatedly called by the
- * collector.
- */
+// sdiagMetric exports a field of the statistics reported by sdiag.
+type sdiagMetric struct {
+	field     string
+	name      string
+	help      string
+	valueType prometheus.ValueType
+}
+
+// sdiagMetrics keeps the names of the metrics of the former parser of the
+// text output of sdiag. Cycle times are in microseconds. Counters are made
+// monotonic, see SchedulerCollector.monotonic.
+var sdiagMetrics = []sdiagMetric{
+	{"req_time_start", "slurm_scheduler_stats_since_seconds", "time the statistics were last reset since epoch", prometheus.GaugeValue},
+	{"server_thread_count", "slurm_scheduler_threads", "number of scheduler threads ", prometheus.GaugeValue},
+	{"agent_queue_size", "slurm_scheduler_queue_size", "length of the scheduler queue", prometheus.GaugeValue},
+	{"agent_count", "slurm_scheduler_agent_count", "number of agents", prometheus.GaugeValue},
+	{"agent_thread_count", "slurm_scheduler_agent_threads", "number of agent threads", prometheus.GaugeValue},
+	{"dbd_agent_queue_size", "slurm_scheduler_dbd_queue_size", "length of the DBD agent queue", prometheus.GaugeValue},
+	{"jobs_submitted", "slurm_scheduler_jobs_submitted_total", "number of jobs submitted since last time stats where reset", prometheus.CounterValue},
+	{"jobs_started", "slurm_scheduler_jobs_started_total", "number of jobs started since last time stats where reset", prometheus.CounterValue},
+	{"jobs_completed", "slurm_scheduler_jobs_completed_total", "number of jobs completed since last time stats where reset", prometheus.CounterValue},
+	{"jobs_canceled", "slurm_scheduler_jobs_canceled_total", "number of jobs canceled since last time stats where reset", prometheus.CounterValue},
+	{"jobs_failed", "slurm_scheduler_jobs_failed_total", "number of jobs failed since last time stats where reset", prometheus.CounterValue},
+	{"jobs_pending", "slurm_scheduler_jobs_pending", "number of pending jobs", prometheus.GaugeValue},
+	{"jobs_running", "slurm_scheduler_jobs_running", "number of running jobs", prometheus.GaugeValue},
+	{"schedule_cycle_last", "slurm_scheduler_last_cycle", "scheduler last cycle time in (microseconds)", prometheus.GaugeValue},
+	{"schedule_cycle_max", "slurm_scheduler_max_cycle", "scheduler max cycle time in (microseconds)", prometheus.GaugeValue},
+	{"schedule_cycle_mean", "slurm_scheduler_mean_cycle", "scheduler mean cycle time in (microseconds)", prometheus.GaugeValue},
+	{"schedule_cycle_mean_depth", "slurm_scheduler_mean_depth_cycle", "scheduler mean depth", prometheus.GaugeValue},
+	{"schedule_cycle_per_minute", "slurm_scheduler_cycle_per_minute", "number scheduler cycles per minute", prometheus.GaugeValue},
+	{"schedule_cycle_total", "slurm_scheduler_cycles_total", "number of scheduler cycles since last time stats where reset", prometheus.CounterValue},
+	{"schedule_queue_length", "slurm_scheduler_last_queue_length", "length of the scheduler queue at the last cycle", prometheus.GaugeValue},
+	{"bf_cycle_last", "slurm_scheduler_backfill_last_cycle", "scheduler backfill last cycle time in (microseconds)", prometheus.GaugeValue},
+	{"bf_cycle_max", "slurm_scheduler_backfill_max_cycle", "scheduler backfill max cycle time in (microseconds)", prometheus.GaugeValue},
+	{"bf_cycle_mean", "slurm_scheduler_backfill_mean_cycle", "scheduler backfill mean cycle time in (microseconds)", prometheus.GaugeValue},
+	{"bf_cycle_counter", "slurm_scheduler_backfill_cycles_total", "number of backfill cycles since last time stats where reset", prometheus.CounterValue},
+	{"bf_depth_mean", "slurm_scheduler_backfill_depth_mean", "scheduler backfill mean depth", prometheus.GaugeValue},
+	{"bf_depth_mean_try", "slurm_scheduler_backfill_depth_try_mean", "scheduler backfill mean depth of the jobs tried", prometheus.GaugeValue},
+	{"bf_last_depth", "slurm_scheduler_backfill_last_depth", "scheduler backfill depth at the last cycle", prometheus.GaugeValue},
+	{"bf_last_depth_try", "slurm_scheduler_backfill_last_depth_try", "scheduler backfill depth of the jobs tried at the last cycle", prometheus.GaugeValue},
+	{"bf_queue_len", "slurm_scheduler_backfill_last_queue_length", "length of the backfill queue at the last cycle", prometheus.GaugeValue},
+	{"bf_queue_len_mean", "slurm_scheduler_backfill_queue_length_mean", "mean length of the backfill queue", prometheus.GaugeValue},
+	{"bf_backfilled_jobs", "slurm_scheduler_backfilled_jobs_since_start_total", "number of jobs started thanks to backfilling since last slurm start", prometheus.CounterValue},
+	{"bf_last_backfilled_jobs", "slurm_scheduler_backfilled_jobs_since_cycle_total", "number of jobs started thanks to backfilling since last time stats where reset", prometheus.GaugeValue},
+	{"bf_backfilled_het_jobs", "slurm_scheduler_backfilled_heterogeneous_total", "number of heterogeneous job components started thanks to backfilling since last Slurm start", prometheus.CounterValue},
+}
+
+// sdiagResetFields are the counters reset along with the statistics, at
+// midnight or by `sdiag -r`, when `Data since` (req_time_start) moves. The
+// other counters are only reset when slurmctld restarts.
+var sdiagResetFields = map[string]bool{
+	"jobs_submitted":       true,
+	"jobs_started":         true,
+	"jobs_completed":       true,
+	"jobs_canceled":        true,
+	"jobs_failed":          true,
+	"schedule_cycle_total": true,
+	"bf_cycle_counter":     true,
+}
+
+type SdiagOutput struct {
+	Statistics struct {
+		RPCsByMessageType []struct {
+			MessageType string      `json:"message_type"`
+			Count       slurmNumber `json:"count"`
+			TotalTime   slurmNumber `json:"total_time"`
+		} `json:"rpcs_by_message_type"`
+		RPCsByUser []struct {
+			User      string      `json:"user"`
+			Count     slurmNumber `json:"count"`
+			TotalTime slurmNumber `json:"total_time"`
+		} `json:"rpcs_by_user"`
+	} `json:"statistics"`
+}
+
+// RPCStats counts the RPCs received by slurmctld, and the time spent
+// processing them in seconds.
+type RPCStats struct {
+	count float64
+	time  float64
+}
 
-// Basic metrics for the scheduler
 type SchedulerMetrics struct {
-	threads                           float64
-	queue_size                        float64
-	dbd_queue_size                    float64
-	last_cycle                        float64
-	mean_cycle                        float64
-	cycle_per_minute                  float64
-	backfill_last_cycle               float64
-	backfill_mean_cycle               float64
-	backfill_depth_mean               float64
-	total_backfilled_jobs_since_start float64
-	total_backfilled_jobs_since_cycle float64
-	total_backfilled_heterogeneous    float64
+	// values of the fields of sdiagMetrics which are set
+	values     map[string]float64
+	rpcsByType map[string]*RPCStats
+	rpcsByUser map[string]*RPCStats
 }
 
 // Extract the relevant metrics from the sdiag output
-func (sc *SchedulerCollector) SchedulerGetMetrics() *SchedulerMetrics {
-	var sm SchedulerMetrics
-	out := getData(sc.isTest, schedulerCommand, schedulerTestData)
-	lines := strings.Split(out, "\n")
-	// Guard variables to check for string repetitions in the output of sdiag
-	// (two occurencies of the following strings: 'Last cycle', 'Mean cycle')
-	lc_count := 0
-	mc_count := 0
-	for _, line := range lines {
-		if strings.Contains(line, ":") {
-			state := strings.Split(line, ":")[0]
-			st := regexp.MustCompile(`^Server thread`)
-			qs := regexp.MustCompile(`^Agent queue`)
-			dbd := regexp.MustCompile(`^DBD Agent`)
-			lc := regexp.MustCompile(`^[\s]+Last cycle$`)
-			mc := regexp.MustCompile(`^[\s]+Mean cycle$`)
-			cpm := regexp.MustCompile(`^[\s]+Cycles per`)
-			dpm := regexp.MustCompile(`^[\s]+Depth Mean$`)
-			tbs := regexp.MustCompile(`^[\s]+Total backfilled jobs \(since last slurm start\)`)
-			tbc := regexp.MustCompile(`^[\s]+Total backfilled jobs \(since last stats cycle start\)`)
-			tbh := regexp.MustCompile(`^[\s]+Total backfilled heterogeneous job components`)
-			switch {
-			case st.MatchString(state) == true:
-				sm.threads, _ = strconv.ParseFloat(strings.TrimSpace(strings.Split(line, ":")[1]), 64)
-			case qs.MatchString(state) == true:
-				sm.queue_size, _ = strconv.ParseFloat(strings.TrimSpace(strings.Split(line, ":")[1]), 64)
-			case dbd.MatchString(state) == true:
-				sm.dbd_queue_size, _ = strconv.ParseFloat(strings.TrimSpace(strings.Split(line, ":")[1]), 64)
-			case lc.MatchString(state) == true:
-				if lc_count == 0 {
-					sm.last_cycle, _ = strconv.ParseFloat(strings.TrimSpace(strings.Split(line, ":")[1]), 64)
-					lc_count = 1
-				}
-				if lc_count == 1 {
-					sm.backfill_last_cycle, _ = strconv.ParseFloat(strings.TrimSpace(strings.Split(line, ":")[1]), 64)
-				}
-			case mc.MatchString(state) == true:
-				if mc_count == 0 {
-					sm.mean_cycle, _ = strconv.ParseFloat(strings.TrimSpace(strings.Split(line, ":")[1]), 64)
-					mc_count = 1
-				}
-				if mc_count == 1 {
-					sm.backfill_mean_cycle, _ = strconv.ParseFloat(strings.TrimSpace(strings.Split(line, ":")[1]), 64)
-				}
-			case cpm.MatchString(state) == true:
-				sm.cycle_per_minute, _ = strconv.ParseFloat(strings.TrimSpace(strings.Split(line, ":")[1]), 64)
-			case dpm.MatchString(state) == true:
-				sm.backfill_depth_mean, _ = strconv.ParseFloat(strings.TrimSpace(strings.Split(line, ":")[1]), 64)
-			case tbs.MatchString(state) == true:
-				sm.total_backfilled_jobs_since_start, _ = strconv.ParseFloat(strings.TrimSpace(strings.Split(line, ":")[1]), 64)
-			case tbc.MatchString(state) == true:
-				sm.total_backfilled_jobs_since_cycle, _ = strconv.ParseFloat(strings.TrimSpace(strings.Split(line, ":")[1]), 64)
-			case tbh.MatchString(state) == true:
-				sm.total_backfilled_heterogeneous, _ = strconv.ParseFloat(strings.TrimSpace(strings.Split(line, ":")[1]), 64)
-			}
+func (sc *SchedulerCollector) SchedulerGetMetrics(ctx context.Context) *SchedulerMetrics {
+	sm := &SchedulerMetrics{
+		values:     make(map[string]float64),
+		rpcsByType: make(map[string]*RPCStats),
+		rpcsByUser: make(map[string]*RPCStats),
+	}
+	data := []byte(getData(ctx, sc.isTest, schedulerCommand, schedulerTestData))
+	// The statistics are decoded twice: as numbers for sdiagMetrics, and
+	// for the RPCs
+	var numbers struct {
+		Statistics map[string]slurmNumber `json:"statistics"`
+	}
+	output := &SdiagOutput{}
+	err := json.Unmarshal(data, &numbers)
+	if err == nil {
+		err = json.Unmarshal(data, output)
+	}
+	if err != nil {
+		ExporterErrors.WithLabelValues("json-encoding-sdiag", err.Error()).Inc()
+		fmt.Println(err)
+		return sm
+	}
+	for _, m := range sdiagMetrics {
+		if v, ok := numbers.Statistics[m.field].Float(); ok {
+			sm.values[m.field] = v
 		}
 	}
-	return &sm
+	// Times are in microseconds
+	for _, rpc := range output.Statistics.RPCsByMessageType {
+		count, _ := rpc.Count.Float()
+		time, _ := rpc.TotalTime.Float()
+		sm.rpcsByType[rpc.MessageType] = &RPCStats{count: count, time: time / 1e6}
+	}
+	for _, rpc := range output.Statistics.RPCsByUser {
+		count, _ := rpc.Count.Float()
+		time, _ := rpc.TotalTime.Float()
+		sm.rpcsByUser[rpc.User] = &RPCStats{count: count, time: time / 1e6}
+	}
+	return sm
+}
+
+// monotonic replaces the counters of sm with values which keep increasing
+// across sdiag resets, so that rate() works. A counter was reset when it went
+// down, or when the statistics were reset for those of sdiagResetFields.
+func (sc *SchedulerCollector) monotonic(sm *SchedulerMetrics) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	since, ok := sm.values["req_time_start"]
+	statsReset := ok && sc.since != 0 && since != sc.since
+	if ok {
+		sc.since = since
+	}
+	count := func(key string, value float64, reset bool) float64 {
+		c, ok := sc.counters[key]
+		if !ok {
+			c = &counterOffset{}
+			sc.counters[key] = c
+		}
+		if reset || value < c.last {
+			c.offset += c.last
+		}
+		c.last = value
+		return value + c.offset
+	}
+	for _, m := range sdiagMetrics {
+		if v, ok := sm.values[m.field]; ok && m.valueType == prometheus.CounterValue {
+			sm.values[m.field] = count(m.field, v, statsReset && sdiagResetFields[m.field])
+		}
+	}
+	for t, rpc := range sm.rpcsByType {
+		rpc.count = count("rpc_count/"+t, rpc.count, false)
+		rpc.time = count("rpc_time/"+t, rpc.time, false)
+	}
+	for user, rpc := range sm.rpcsByUser {
+		rpc.count = count("user_rpc_count/"+user, rpc.count, false)
+		rpc.time = count("user_rpc_time/"+user, rpc.time, false)
+	}
 }
 
 /*
@@ -104,119 +191,87 @@ func (sc *SchedulerCollector) SchedulerGetMetrics() *SchedulerMetrics {
  * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
  */
 
+// counterOffset turns a counter which gets reset into a monotonic one: the
+// last value seen before every reset is added to offset.
+type counterOffset struct {
+	last   float64
+	offset float64
+}
+
 // Collector strcture
 type SchedulerCollector struct {
-	isTest                            bool
-	threads                           *prometheus.Desc
-	queue_size                        *prometheus.Desc
-	dbd_queue_size                    *prometheus.Desc
-	last_cycle                        *prometheus.Desc
-	mean_cycle                        *prometheus.Desc
-	cycle_per_minute                  *prometheus.Desc
-	backfill_last_cycle               *prometheus.Desc
-	backfill_mean_cycle               *prometheus.Desc
-	backfill_depth_mean               *prometheus.Desc
-	total_backfilled_jobs_since_start *prometheus.Desc
-	total_backfilled_jobs_since_cycle *prometheus.Desc
-	total_backfilled_heterogeneous    *prometheus.Desc
+	isTest bool
+	// State of the counters across sdiag resets
+	mu       sync.Mutex
+	since    float64
+	counters map[string]*counterOffset
+	// descs of sdiagMetrics by field
+	descs        map[string]*prometheus.Desc
+	rpcCount     *prometheus.Desc
+	rpcTime      *prometheus.Desc
+	rpcUserCount *prometheus.Desc
+	rpcUserTime  *prometheus.Desc
 }
 
 // Send all metric descriptions
 func (c *SchedulerCollector) Describe(ch chan<- *prometheus.Desc) {
-	ch <- c.threads
-	ch <- c.queue_size
-	ch <- c.dbd_queue_size
-	ch <- c.last_cycle
-	ch <- c.mean_cycle
-	ch <- c.cycle_per_minute
-	ch <- c.backfill_last_cycle
-	ch <- c.backfill_mean_cycle
-	ch <- c.backfill_depth_mean
-	ch <- c.total_backfilled_jobs_since_start
-	ch <- c.total_backfilled_jobs_since_cycle
-	ch <- c.total_backfilled_heterogeneous
+	for _, m := range sdiagMetrics {
+		ch <- c.descs[m.field]
+	}
+	ch <- c.rpcCount
+	ch <- c.rpcTime
+	ch <- c.rpcUserCount
+	ch <- c.rpcUserTime
 }
 
 // Send the values of all metrics
-func (sc *SchedulerCollector) Collect(ch chan<- prometheus.Metric) {
-	sm := sc.SchedulerGetMetrics()
-	ch <- prometheus.MustNewConstMetric(sc.threads, prometheus.GaugeValue, sm.threads)
-	ch <- prometheus.MustNewConstMetric(sc.queue_size, prometheus.GaugeValue, sm.queue_size)
-	ch <- prometheus.MustNewConstMetric(sc.dbd_queue_size, prometheus.GaugeValue, sm.dbd_queue_size)
-	ch <- prometheus.MustNewConstMetric(sc.last_cycle, prometheus.GaugeValue, sm.last_cycle)
-	ch <- prometheus.MustNewConstMetric(sc.mean_cycle, prometheus.GaugeValue, sm.mean_cycle)
-	ch <- prometheus.MustNewConstMetric(sc.cycle_per_minute, prometheus.GaugeValue, sm.cycle_per_minute)
-	ch <- prometheus.MustNewConstMetric(sc.backfill_last_cycle, prometheus.GaugeValue, sm.backfill_last_cycle)
-	ch <- prometheus.MustNewConstMetric(sc.backfill_mean_cycle, prometheus.GaugeValue, sm.backfill_mean_cycle)
-	ch <- prometheus.MustNewConstMetric(sc.backfill_depth_mean, prometheus.GaugeValue, sm.backfill_depth_mean)
-	ch <- prometheus.MustNewConstMetric(sc.total_backfilled_jobs_since_start, prometheus.GaugeValue, sm.total_backfilled_jobs_since_start)
-	ch <- prometheus.MustNewConstMetric(sc.total_backfilled_jobs_since_cycle, prometheus.GaugeValue, sm.total_backfilled_jobs_since_cycle)
-	ch <- prometheus.MustNewConstMetric(sc.total_backfilled_heterogeneous, prometheus.GaugeValue, sm.total_backfilled_heterogeneous)
+func (sc *SchedulerCollector) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	sm := sc.SchedulerGetMetrics(ctx)
+	sc.monotonic(sm)
+	for _, m := range sdiagMetrics {
+		if v, ok := sm.values[m.field]; ok {
+			ch <- prometheus.MustNewConstMetric(sc.descs[m.field], m.valueType, v)
+		}
+	}
+	for t, rpc := range sm.rpcsByType {
+		ch <- prometheus.MustNewConstMetric(sc.rpcCount, prometheus.CounterValue, rpc.count, t)
+		ch <- prometheus.MustNewConstMetric(sc.rpcTime, prometheus.CounterValue, rpc.time, t)
+	}
+	for user, rpc := range sm.rpcsByUser {
+		ch <- prometheus.MustNewConstMetric(sc.rpcUserCount, prometheus.CounterValue, rpc.count, user)
+		ch <- prometheus.MustNewConstMetric(sc.rpcUserTime, prometheus.CounterValue, rpc.time, user)
+	}
 }
 
 // Returns the Slurm scheduler collector, used to register with the prometheus client
 func NewSchedulerCollector(isTest bool) *SchedulerCollector {
+	descs := make(map[string]*prometheus.Desc, len(sdiagMetrics))
+	for _, m := range sdiagMetrics {
+		descs[m.field] = prometheus.NewDesc(m.name, "Information provided by the Slurm sdiag command, "+m.help, nil, nil)
+	}
 	return &SchedulerCollector{
-		isTest: isTest,
-		threads: prometheus.NewDesc(
-			"slurm_scheduler_threads",
-			"Information provided by the Slurm sdiag command, number of scheduler threads ",
-			nil,
-			nil),
-		queue_size: prometheus.NewDesc(
-			"slurm_scheduler_queue_size",
-			"Information provided by the Slurm sdiag command, length of the scheduler queue",
-			nil,
-			nil),
-		dbd_queue_size: prometheus.NewDesc(
-			"slurm_scheduler_dbd_queue_size",
-			"Information provided by the Slurm sdiag command, length of the DBD agent queue",
-			nil,
-			nil),
-		last_cycle: prometheus.NewDesc(
-			"slurm_scheduler_last_cycle",
-			"Information provided by the Slurm sdiag command, scheduler last cycle time in (microseconds)",
-			nil,
-			nil),
-		mean_cycle: prometheus.NewDesc(
-			"slurm_scheduler_mean_cycle",
-			"Information provided by the Slurm sdiag command, scheduler mean cycle time in (microseconds)",
-			nil,
-			nil),
-		cycle_per_minute: prometheus.NewDesc(
-			"slurm_scheduler_cycle_per_minute",
-			"Information provided by the Slurm sdiag command, number scheduler cycles per minute",
-			nil,
-			nil),
-		backfill_last_cycle: prometheus.NewDesc(
-			"slurm_scheduler_backfill_last_cycle",
-			"Information provided by the Slurm sdiag command, scheduler backfill last cycle time in (microseconds)",
-			nil,
-			nil),
-		backfill_mean_cycle: prometheus.NewDesc(
-			"slurm_scheduler_backfill_mean_cycle",
-			"Information provided by the Slurm sdiag command, scheduler backfill mean cycle time in (microseconds)",
-			nil,
-			nil),
-		backfill_depth_mean: prometheus.NewDesc(
-			"slurm_scheduler_backfill_depth_mean",
-			"Information provided by the Slurm sdiag command, scheduler backfill mean depth",
-			nil,
+		isTest:   isTest,
+		counters: make(map[string]*counterOffset),
+		descs:    descs,
+		rpcCount: prometheus.NewDesc(
+			"slurm_scheduler_rpc_calls_total",
+			"Information provided by the Slurm sdiag command, number of RPCs received by slurmctld by message type",
+			[]string{"type"},
 			nil),
-		total_backfilled_jobs_since_start: prometheus.NewDesc(
-			"slurm_scheduler_backfilled_jobs_since_start_total",
-			"Information provided by the Slurm sdiag command, number of jobs started thanks to backfilling since last slurm start",
-			nil,
+		rpcTime: prometheus.NewDesc(
+			"slurm_scheduler_rpc_duration_seconds_total",
+			"Information provided by the Slurm sdiag command, time spent by slurmctld processing RPCs by message type",
+			[]string{"type"},
 			nil),
-		total_backfilled_jobs_since_cycle: prometheus.NewDesc(
-			"slurm_scheduler_backfilled_jobs_since_cycle_total",
-			"Information provided by the Slurm sdiag command, number of jobs started thanks to backfilling since last time stats where reset",
-			nil,
+		rpcUserCount: prometheus.NewDesc(
+			"slurm_scheduler_user_rpc_calls_total",
+			"Information provided by the Slurm sdiag command, number of RPCs received by slurmctld by user",
+			[]string{"user"},
 			nil),
-		total_backfilled_heterogeneous: prometheus.NewDesc(
-			"slurm_scheduler_backfilled_heterogeneous_total",
-			"Information provided by the Slurm sdiag command, number of heterogeneous job components started thanks to backfilling since last Slurm start",
-			nil,
+		rpcUserTime: prometheus.NewDesc(
+			"slurm_scheduler_user_rpc_duration_seconds_total",
+			"Information provided by the Slurm sdiag command, time spent by slurmctld processing RPCs by user",
+			[]string{"user"},
 			nil),
 	}
 }
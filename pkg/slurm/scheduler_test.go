@@ -3,10 +3,81 @@
 package slurm
 
 import (
+	"context"
+	"strings"
 	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestSchedulerGetMetrics(t *testing.T) {
 	coll := NewSchedulerCollector(true)
-	t.Logf("%+v", coll.SchedulerGetMetrics())
+	sm := coll.SchedulerGetMetrics(context.Background())
+	t.Logf("%+v", sm)
+	// The main and backfill cycles are no longer mixed up
+	assert.Equal(t, 97209.0, sm.values["schedule_cycle_last"])
+	assert.Equal(t, 1942890.0, sm.values["bf_cycle_last"])
+	assert.Equal(t, 74593.0, sm.values["schedule_cycle_mean"])
+	assert.Equal(t, 1960820.0, sm.values["bf_cycle_mean"])
+	assert.Equal(t, 9706.0, sm.values["jobs_submitted"])
+	assert.Equal(t, 57064.0, sm.values["bf_queue_len"])
+	assert.Equal(t, &RPCStats{count: 9706, time: 68.550024}, sm.rpcsByType["REQUEST_SUBMIT_BATCH_JOB"])
+	assert.Len(t, sm.rpcsByUser, 2)
+}
+
+func TestSchedulerCollector(t *testing.T) {
+	collector := &scrapeCollector{ctx: context.Background(), collector: NewSchedulerCollector(true)}
+	expected := `
+# HELP slurm_scheduler_backfill_last_cycle Information provided by the Slurm sdiag command, scheduler backfill last cycle time in (microseconds)
+# TYPE slurm_scheduler_backfill_last_cycle gauge
+slurm_scheduler_backfill_last_cycle 1.94289e+06
+# HELP slurm_scheduler_last_cycle Information provided by the Slurm sdiag command, scheduler last cycle time in (microseconds)
+# TYPE slurm_scheduler_last_cycle gauge
+slurm_scheduler_last_cycle 97209
+# HELP slurm_scheduler_user_rpc_calls_total Information provided by the Slurm sdiag command, number of RPCs received by slurmctld by user
+# TYPE slurm_scheduler_user_rpc_calls_total counter
+slurm_scheduler_user_rpc_calls_total{user="alice"} 5120
+slurm_scheduler_user_rpc_calls_total{user="root"} 130210
+`
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(expected),
+		"slurm_scheduler_backfill_last_cycle", "slurm_scheduler_last_cycle", "slurm_scheduler_user_rpc_calls_total"))
+	// Every statistic of sdiagMetrics is in the test data, plus 3 message
+	// types and 2 users
+	assert.Equal(t, len(sdiagMetrics)+2*3+2*2, testutil.CollectAndCount(collector))
+}
+
+func TestSchedulerMonotonic(t *testing.T) {
+	coll := NewSchedulerCollector(true)
+	scrape := func(since, submitted, backfilled, rpcs float64) *SchedulerMetrics {
+		sm := &SchedulerMetrics{
+			values: map[string]float64{
+				"req_time_start":     since,
+				"jobs_submitted":     submitted,
+				"bf_backfilled_jobs": backfilled,
+				"bf_cycle_mean":      1000,
+			},
+			rpcsByType: map[string]*RPCStats{"REQUEST_PING": {count: rpcs}},
+			rpcsByUser: map[string]*RPCStats{},
+		}
+		coll.monotonic(sm)
+		return sm
+	}
+	sm := scrape(100, 10, 5, 50)
+	assert.Equal(t, 10.0, sm.values["jobs_submitted"])
+
+	// Midnight: the jobs submitted since are more than before already,
+	// the backfilled jobs since slurmctld started are not reset
+	sm = scrape(200, 12, 7, 60)
+	assert.Equal(t, 200.0, sm.values["req_time_start"])
+	assert.Equal(t, 22.0, sm.values["jobs_submitted"])
+	assert.Equal(t, 7.0, sm.values["bf_backfilled_jobs"])
+	assert.Equal(t, 1000.0, sm.values["bf_cycle_mean"])
+	assert.Equal(t, 60.0, sm.rpcsByType["REQUEST_PING"].count)
+
+	// slurmctld restarted
+	sm = scrape(300, 1, 1, 2)
+	assert.Equal(t, 23.0, sm.values["jobs_submitted"])
+	assert.Equal(t, 8.0, sm.values["bf_backfilled_jobs"])
+	assert.Equal(t, 62.0, sm.rpcsByType["REQUEST_PING"].count)
 }
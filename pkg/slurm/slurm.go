@@ -4,15 +4,25 @@
 package slurm
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os/exec"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/MarshallWace/slurm-exporter/pkg/ldapsearch"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	scrapeTimeoutHeader = "X-Prometheus-Scrape-Timeout-Seconds"
 )
 
 var (
@@ -30,29 +40,214 @@ var (
 			Help:      "Duration of exec commands.",
 		},
 		[]string{"command"})
+	ExecAborted = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: "",
+			Name:      "slurm_exporter_exec_aborted_total",
+			Help:      "Total number of exec commands killed because the scrape was cancelled or timed out.",
+		},
+		[]string{"command"})
 	execTimeoutSeconds = 10
 )
 
-func getData(isTest bool, command, file string) string {
+type scrapeCacheKey struct{}
+
+// scrapeCache shares the data needed by several collectors, such as the
+// output of squeue, during a single scrape.
+type scrapeCache struct {
+	mu      sync.Mutex
+	entries map[string]*scrapeCacheEntry
+}
+
+type scrapeCacheEntry struct {
+	once  sync.Once
+	value interface{}
+}
+
+func withScrapeCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, scrapeCacheKey{}, &scrapeCache{entries: map[string]*scrapeCacheEntry{}})
+}
+
+// cached returns the value computed by fn for key, calling fn at most once per
+// scrape. Outside of a scrape fn is called every time.
+func cached(ctx context.Context, key string, fn func() interface{}) interface{} {
+	cache, ok := ctx.Value(scrapeCacheKey{}).(*scrapeCache)
+	if !ok {
+		return fn()
+	}
+	cache.mu.Lock()
+	entry, ok := cache.entries[key]
+	if !ok {
+		entry = &scrapeCacheEntry{}
+		cache.entries[key] = entry
+	}
+	cache.mu.Unlock()
+	entry.once.Do(func() {
+		entry.value = fn()
+	})
+	return entry.value
+}
+
+// Config holds the exporter settings, usually coming from the command line.
+type Config struct {
+	GPUAcct        bool
+	ControllerPing bool
+	FinishedJobs   bool
+	JobEfficiency  bool
+	Sstat          bool
+	Reservations   bool
+	Licenses       bool
+	QOS            bool
+	Associations   bool
+	Sprio          bool
+	DBDStats       bool
+	// SstatMaxJobs bounds the running jobs queried with sstat per scrape, 0
+	// meaning all of them.
+	SstatMaxJobs int
+	// SprioMaxSeries bounds the per job priority series, 0 disabling them.
+	SprioMaxSeries int
+	// JobArrays reports array jobs per task, per array or both, see
+	// JobArraysTasks and siblings. Per task when empty.
+	JobArrays string
+	// PendingReasonsFile overrides the categories of the reasons of pending
+	// jobs with its Reason=category lines.
+	PendingReasonsFile string
+	// StateDir keeps the state of the collectors across restarts, nothing is
+	// persisted when empty.
+	StateDir           string
+	ExecTimeoutSeconds int
+	NodeAddressSuffix  string
+	LDAPServer         string
+	LDAPBaseSearch     string
+	// ScrapeTimeoutOffset is subtracted from the timeout announced by
+	// Prometheus, leaving time to encode and send the response.
+	ScrapeTimeoutOffset time.Duration
+	// MaxConcurrentCommands bounds the Slurm commands running at once, 0
+	// meaning no limit.
+	MaxConcurrentCommands int
+	// BreakerThreshold is the number of consecutive command timeouts after
+	// which commands stop being run, 0 disabling the circuit breaker.
+	BreakerThreshold  int
+	BreakerMinBackoff time.Duration
+	BreakerMaxBackoff time.Duration
+}
+
+// ContextCollector is a prometheus.Collector whose collection is bound to the
+// context of the scrape that triggered it, so the commands it runs are killed
+// as soon as Prometheus gives up on the scrape.
+type ContextCollector interface {
+	Describe(ch chan<- *prometheus.Desc)
+	CollectContext(ctx context.Context, ch chan<- prometheus.Metric)
+}
+
+// scrapeCollector adapts a ContextCollector to a prometheus.Collector for the
+// duration of a single scrape.
+type scrapeCollector struct {
+	ctx       context.Context
+	collector ContextCollector
+}
+
+func (s *scrapeCollector) Describe(ch chan<- *prometheus.Desc) {
+	s.collector.Describe(ch)
+}
+
+func (s *scrapeCollector) Collect(ch chan<- prometheus.Metric) {
+	s.collector.CollectContext(s.ctx, ch)
+}
+
+func getData(ctx context.Context, isTest bool, command, file string) string {
 	if isTest {
 		return readFile(file)
 	}
-	return execCommand(command)
+	return execCommand(ctx, command)
 }
 
-func execCommand(command string) string {
-	cmdList := strings.Split(command, " ")
-	before := time.Now()
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(execTimeoutSeconds)*time.Second)
+func execCommand(ctx context.Context, command string) string {
+	out, err := runCommand(ctx, command, strings.Split(command, " "))
+	if err != nil {
+		return ""
+	}
+	return out
+}
+
+// execCommandArgs is execCommand for commands whose arguments change between
+// scrapes, such as time windows; only command labels the exporter's metrics.
+func execCommandArgs(ctx context.Context, command string, args ...string) string {
+	out, err := runCommand(ctx, command, append(strings.Split(command, " "), args...))
+	if err != nil {
+		return ""
+	}
+	return out
+}
+
+// runCommand executes cmdList and returns its standard output. label is used
+// for the exporter's own metrics. The command waits for a slot of the
+// concurrency limit and is not run at all while the circuit breaker is open.
+func runCommand(ctx context.Context, label string, cmdList []string) (string, error) {
+	err := commandLimiter.acquire(ctx)
+	if err != nil {
+		ExecRejected.WithLabelValues(label, "concurrency_limit").Inc()
+		return "", err
+	}
+	defer commandLimiter.release()
+	generation, ok := controllerBreaker.allow()
+	if !ok {
+		ExecRejected.WithLabelValues(label, "circuit_open").Inc()
+		return "", errCircuitOpen
+	}
+	out, err := startCommand(ctx, label, cmdList)
+	controllerBreaker.done(generation, err)
+	return out, err
+}
+
+// probeCommand is runCommand without the circuit breaker, for the commands
+// which are cheap and tell whether slurmctld is responsive at all.
+func probeCommand(ctx context.Context, label string, cmdList []string) (string, error) {
+	err := commandLimiter.acquire(ctx)
+	if err != nil {
+		ExecRejected.WithLabelValues(label, "concurrency_limit").Inc()
+		return "", err
+	}
+	defer commandLimiter.release()
+	return startCommand(ctx, label, cmdList)
+}
+
+// startCommand is bound to both ctx and the exec timeout; the command runs in
+// its own process group so that anything it forked is killed along with it
+// when the context is done.
+func startCommand(ctx context.Context, label string, cmdList []string) (string, error) {
+	ExecInFlight.Inc()
+	defer ExecInFlight.Dec()
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(execTimeoutSeconds)*time.Second)
 	defer cancel()
-	out, err := exec.CommandContext(ctx, cmdList[0], cmdList[1:]...).Output()
+	var stdout bytes.Buffer
+	cmd := exec.Command(cmdList[0], cmdList[1:]...)
+	cmd.Stdout = &stdout
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	before := time.Now()
+	err := cmd.Start()
+	if err == nil {
+		done := make(chan error, 1)
+		go func() {
+			done <- cmd.Wait()
+		}()
+		select {
+		case err = <-done:
+		case <-ctx.Done():
+			// A negative pid signals the whole process group
+			_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+			<-done
+			err = ctx.Err()
+			ExecAborted.WithLabelValues(label).Inc()
+		}
+	}
 	elapsed := time.Since(before)
-	ExecDuration.WithLabelValues(command).Observe(elapsed.Seconds())
+	ExecDuration.WithLabelValues(label).Observe(elapsed.Seconds())
 	if err != nil {
-		ExporterErrors.WithLabelValues(command, err.Error()).Inc()
-		return ""
+		ExporterErrors.WithLabelValues(label, err.Error()).Inc()
+		return stdout.String(), err
 	}
-	return string(out)
+	return stdout.String(), nil
 }
 
 func readFile(filePath string) string {
@@ -64,71 +259,168 @@ func readFile(filePath string) string {
 	return string(rawData)
 }
 
-func NewRegistry(gpuCollectorEnabled bool, exectimeout int, nodeAddressSuffix, ldapServer, ldapBaseSearch string) (*prometheus.Registry, error) {
-	reg := prometheus.NewRegistry()
-	execTimeoutSeconds = exectimeout
-	err := reg.Register(NewAccountsCollector()) // from accounts.go
-	if err != nil {
-		return nil, err
+// scrapeContext derives the context of a scrape from its HTTP request, using
+// the timeout Prometheus announces in the X-Prometheus-Scrape-Timeout-Seconds
+// header when there is one.
+func scrapeContext(r *http.Request, offset time.Duration) (context.Context, context.CancelFunc) {
+	header := r.Header.Get(scrapeTimeoutHeader)
+	if header == "" {
+		return context.WithCancel(r.Context())
 	}
-	err = reg.Register(NewCPUsCollector(false)) // from cpus.go
+	seconds, err := strconv.ParseFloat(header, 64)
 	if err != nil {
-		return nil, err
+		ExporterErrors.WithLabelValues("scrape-timeout-header", err.Error()).Inc()
+		return context.WithCancel(r.Context())
 	}
-	err = reg.Register(NewPartitionsCollector()) // from partitions.go
-	if err != nil {
-		return nil, err
+	timeout := time.Duration(seconds * float64(time.Second))
+	if timeout > offset {
+		timeout -= offset
 	}
-	err = reg.Register(NewQueueCollector(false)) // from queue.go
+	return context.WithTimeout(r.Context(), timeout)
+}
+
+// Exporter serves the Slurm metrics. Slurm collectors are bound to the context
+// of each scrape while the exporter's own metrics live in a static registry.
+type Exporter struct {
+	registry            *prometheus.Registry
+	collectors          []ContextCollector
+	scrapeTimeoutOffset time.Duration
+}
+
+func NewExporter(cfg Config) (*Exporter, error) {
+	execTimeoutSeconds = cfg.ExecTimeoutSeconds
+	commandLimiter = newLimiter(cfg.MaxConcurrentCommands)
+	controllerBreaker = newCircuitBreaker(cfg.BreakerThreshold, cfg.BreakerMinBackoff, cfg.BreakerMaxBackoff)
+	e := &Exporter{
+		registry:            prometheus.NewRegistry(),
+		scrapeTimeoutOffset: cfg.ScrapeTimeoutOffset,
+	}
+	err := e.registry.Register(ExporterErrors) // from this file
 	if err != nil {
 		return nil, err
 	}
-	err = reg.Register(NewSchedulerCollector(false)) // from scheduler.go
+	err = e.registry.Register(ExecDuration) // from this file
 	if err != nil {
 		return nil, err
 	}
-	err = reg.Register(NewFairShareCollector()) // from sshare.go
+	err = e.registry.Register(ExecAborted) // from this file
 	if err != nil {
 		return nil, err
 	}
-	err = reg.Register(NewUsersCollector()) // from users.go
+	err = e.registry.Register(ExecInFlight) // from breaker.go
 	if err != nil {
 		return nil, err
 	}
-	err = reg.Register(ExporterErrors) // from this file
+	err = e.registry.Register(ExecRejected) // from breaker.go
 	if err != nil {
 		return nil, err
 	}
-	err = reg.Register(ExecDuration) // from this file
+	err = e.registry.Register(BreakerState) // from breaker.go
 	if err != nil {
 		return nil, err
 	}
-	err = reg.Register(NewNodesCollector(false, nodeAddressSuffix)) // from scontrol.go
+	err = e.registry.Register(BreakerTimeouts) // from breaker.go
 	if err != nil {
 		return nil, err
 	}
-	if ldapServer != "" {
-		ldap, err := ldapsearch.Init("", ldapServer, ldapBaseSearch)
+
+	var ldap *ldapsearch.Search
+	if cfg.LDAPServer != "" {
+		ldap, err = ldapsearch.Init("", cfg.LDAPServer, cfg.LDAPBaseSearch)
 		if err != nil {
 			ExporterErrors.WithLabelValues("ldapsearch", err.Error()).Inc()
 			fmt.Println(err)
 		}
-		err = reg.Register(NewJobsCollector(false, ldap)) // from jobs.go
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		err = reg.Register(NewJobsCollector(false, nil)) // from jobs.go
+	}
+	switch cfg.JobArrays {
+	case "":
+		cfg.JobArrays = JobArraysTasks
+	case JobArraysTasks, JobArraysAggregate, JobArraysBoth:
+	default:
+		return nil, fmt.Errorf("unknown job arrays mode %q, expected %s, %s or %s", cfg.JobArrays, JobArraysTasks, JobArraysAggregate, JobArraysBoth)
+	}
+	reasonCategories, err := loadReasonCategories(cfg.PendingReasonsFile) // from queue.go
+	if err != nil {
+		return nil, err
+	}
+	e.collectors = []ContextCollector{
+		NewAccountsCollector(),                          // from accounts.go
+		NewCPUsCollector(false),                         // from cpus.go
+		NewPartitionsCollector(false),                   // from partitions.go
+		NewQueueCollector(false, reasonCategories),      // from queue.go
+		NewSchedulerCollector(false),                    // from scheduler.go
+		NewFairShareCollector(false),                    // from sshare.go
+		NewUsersCollector(),                             // from users.go
+		NewNodesCollector(false, cfg.NodeAddressSuffix), // from nodes.go
+		NewJobsCollector(false, ldap, cfg.JobArrays),    // from jobs.go
+		NewPendingCollector(false),                      // from pending.go
+	}
+	if cfg.GPUAcct {
+		e.collectors = append(e.collectors, NewGPUsCollector()) // from gpus.go
+	}
+	if cfg.ControllerPing {
+		e.collectors = append(e.collectors, NewPingCollector(false)) // from ping.go
+	}
+	if cfg.FinishedJobs {
+		e.collectors = append(e.collectors, NewFinishedJobsCollector(false, cfg.StateDir)) // from sacct.go
+	}
+	if cfg.JobEfficiency {
+		e.collectors = append(e.collectors, NewEfficiencyCollector(false, ldap, cfg.StateDir)) // from efficiency.go
+	}
+	if cfg.Sstat {
+		e.collectors = append(e.collectors, NewSstatCollector(false, cfg.SstatMaxJobs)) // from sstat.go
+	}
+	if cfg.Reservations {
+		e.collectors = append(e.collectors, NewReservationsCollector(false)) // from reservations.go
+	}
+	if cfg.Licenses {
+		e.collectors = append(e.collectors, NewLicensesCollector(false)) // from licenses.go
+	}
+	if cfg.QOS {
+		e.collectors = append(e.collectors, NewQOSCollector(false)) // from qos.go
+	}
+	if cfg.Associations {
+		e.collectors = append(e.collectors, NewAssocCollector(false)) // from assoc.go
+	}
+	if cfg.Sprio {
+		e.collectors = append(e.collectors, NewSprioCollector(false, cfg.SprioMaxSeries)) // from sprio.go
+	}
+	if cfg.DBDStats {
+		e.collectors = append(e.collectors, NewDBDCollector(false)) // from dbd.go
+	}
+
+	// Registering once upfront reports inconsistent collectors at startup
+	// rather than on every scrape.
+	check := prometheus.NewRegistry()
+	for _, c := range e.collectors {
+		err = check.Register(&scrapeCollector{ctx: context.Background(), collector: c})
 		if err != nil {
 			return nil, err
 		}
 	}
-	if gpuCollectorEnabled {
-		err = reg.Register(NewGPUsCollector()) // from gpus.go
+	return e, nil
+}
+
+// MustRegister adds collectors which do not depend on the scrape context, such
+// as the process and Go runtime collectors.
+func (e *Exporter) MustRegister(cs ...prometheus.Collector) {
+	e.registry.MustRegister(cs...)
+}
+
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := scrapeContext(r, e.scrapeTimeoutOffset)
+	defer cancel()
+	ctx = withScrapeCache(ctx)
+	reg := prometheus.NewRegistry()
+	for _, c := range e.collectors {
+		err := reg.Register(&scrapeCollector{ctx: ctx, collector: c})
 		if err != nil {
-			return nil, err
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 	}
-
-	return reg, nil
+	// The scrape registry goes first so that errors it produces are part of
+	// this very response.
+	gatherers := prometheus.Gatherers{reg, e.registry}
+	promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{}).ServeHTTP(w, r)
 }
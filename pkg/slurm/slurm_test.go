@@ -0,0 +1,44 @@
+// SPDX-FileCopyrightText: 2022 2022 Marshall Wace <opensource@mwam.com>
+//
+// SPDX-License-Identifier: GPL3
+
+package slurm
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunCommandAborted(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	label := "sleep-test"
+	before := time.Now()
+	// The background sleep keeps stdout open, only killing the process group
+	// lets the command return.
+	_, err := runCommand(ctx, label, []string{"sh", "-c", "sleep 10 & sleep 10"})
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(before) < 5*time.Second)
+	assert.Equal(t, 1.0, testutil.ToFloat64(ExecAborted.WithLabelValues(label)))
+}
+
+func TestScrapeContext(t *testing.T) {
+	r := httptest.NewRequest("GET", "/metrics", nil)
+	r.Header.Set(scrapeTimeoutHeader, "10")
+	ctx, cancel := scrapeContext(r, time.Second)
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	assert.True(t, ok)
+	assert.InDelta(t, 9, time.Until(deadline).Seconds(), 0.5)
+
+	r.Header.Del(scrapeTimeoutHeader)
+	ctx, cancel = scrapeContext(r, time.Second)
+	defer cancel()
+	_, ok = ctx.Deadline()
+	assert.False(t, ok)
+}
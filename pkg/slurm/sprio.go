@@ -0,0 +1,176 @@
+// SPDX-FileCopyrightText: 2022 2022 Marshall Wace <opensource@mwam.com>
+//
+// SPDX-License-Identifier: GPL3
+
+package slurm
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	sprioCommand  = "sprio -h -o %i|%r|%u|%o|%Y|%A|%F|%J|%P|%Q|%B|%T"
+	sprioTestData = "test_data/sprio.txt"
+)
+
+var (
+	// sprioFactors follow the weighted columns of sprioCommand after the job
+	// priority itself
+	sprioFactors = []string{"age", "fairshare", "jobsize", "partition", "qos", "assoc", "tres"}
+	// Weighted factors go up to the PriorityWeight* settings, usually a few
+	// thousands and at most 2^32
+	priorityBuckets = prometheus.ExponentialBuckets(1, 4, 16)
+)
+
+// JobPriority is the weighted priority of a pending job in one of the
+// partitions it was submitted to, along with its factors.
+type JobPriority struct {
+	jobID     string
+	partition string
+	user      string
+	account   string
+	priority  float64
+	factors   map[string]float64
+}
+
+// parseWeightedTRES sums the weighted TRES factors, e.g. `cpu=100,gres/gpu=900`.
+func parseWeightedTRES(s string) float64 {
+	var sum float64
+	for _, tres := range strings.Split(s, ",") {
+		kv := strings.SplitN(tres, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		if value, err := strconv.ParseFloat(kv[1], 64); err == nil {
+			sum += value
+		}
+	}
+	return sum
+}
+
+// ParseSprioOutput returns a JobPriority per job and partition, jobs submitted
+// to several partitions being listed once for each of them.
+func ParseSprioOutput(out string) []*JobPriority {
+	var jobs []*JobPriority
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, "|")
+		if len(fields) < 5+len(sprioFactors) {
+			continue
+		}
+		priority, err := strconv.ParseFloat(fields[4], 64)
+		if err != nil {
+			continue
+		}
+		job := &JobPriority{
+			jobID:     strings.TrimSpace(fields[0]),
+			partition: fields[1],
+			user:      fields[2],
+			account:   fields[3],
+			priority:  priority,
+			factors:   make(map[string]float64, len(sprioFactors)),
+		}
+		for i, factor := range sprioFactors {
+			if factor == "tres" {
+				job.factors[factor] = parseWeightedTRES(fields[5+i])
+				continue
+			}
+			job.factors[factor], _ = strconv.ParseFloat(fields[5+i], 64)
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+/*
+ * Implement the Prometheus Collector interface and feed the
+ * Slurm job priorities into it.
+ * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
+ */
+
+type SprioCollector struct {
+	isTest bool
+	// maxSeries bounds the per job series, 0 disabling them
+	maxSeries   int
+	priority    *prometheus.Desc
+	factor      *prometheus.Desc
+	jobPriority *prometheus.Desc
+	jobFactor   *prometheus.Desc
+	jobsDropped *prometheus.Desc
+}
+
+func NewSprioCollector(isTest bool, maxSeries int) *SprioCollector {
+	labels := []string{"partition", "account"}
+	jobLabels := []string{"job_id", "user", "partition", "account"}
+	return &SprioCollector{
+		isTest:      isTest,
+		maxSeries:   maxSeries,
+		priority:    prometheus.NewDesc("slurm_pending_job_priority", "Distribution of the priority of pending jobs", labels, nil),
+		factor:      prometheus.NewDesc("slurm_pending_job_priority_factor", "Distribution of the weighted priority factors of pending jobs", append(labels, "factor"), nil),
+		jobPriority: prometheus.NewDesc("slurm_job_priority", "Priority of a pending job", jobLabels, nil),
+		jobFactor:   prometheus.NewDesc("slurm_job_priority_factor", "Weighted priority factor of a pending job", append(jobLabels, "factor"), nil),
+		jobsDropped: prometheus.NewDesc("slurm_job_priority_jobs_dropped", "Pending jobs left out of the per job priority series to stay within the maximum number of series", nil, nil),
+	}
+}
+
+func (sc *SprioCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sc.priority
+	ch <- sc.factor
+	if sc.maxSeries > 0 {
+		ch <- sc.jobPriority
+		ch <- sc.jobFactor
+		ch <- sc.jobsDropped
+	}
+}
+
+func (sc *SprioCollector) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	jobs := ParseSprioOutput(getData(ctx, sc.isTest, sprioCommand, sprioTestData))
+	priorities := make(map[[2]string]*constHistogram)
+	factors := make(map[[3]string]*constHistogram)
+	for _, job := range jobs {
+		key := [2]string{job.partition, job.account}
+		if priorities[key] == nil {
+			priorities[key] = newConstHistogram(priorityBuckets)
+		}
+		priorities[key].observe(job.priority)
+		for factor, value := range job.factors {
+			key := [3]string{job.partition, job.account, factor}
+			if factors[key] == nil {
+				factors[key] = newConstHistogram(priorityBuckets)
+			}
+			factors[key].observe(value)
+		}
+	}
+	for key, h := range priorities {
+		ch <- h.metric(sc.priority, key[0], key[1])
+	}
+	for key, h := range factors {
+		ch <- h.metric(sc.factor, key[0], key[1], key[2])
+	}
+	if sc.maxSeries > 0 {
+		sc.collectJobs(jobs, ch)
+	}
+}
+
+// collectJobs reports the priority of the jobs at the top of the queue, as
+// many as fit in maxSeries.
+func (sc *SprioCollector) collectJobs(jobs []*JobPriority, ch chan<- prometheus.Metric) {
+	sort.SliceStable(jobs, func(i, j int) bool { return jobs[i].priority > jobs[j].priority })
+	series, dropped := 0, 0
+	for _, job := range jobs {
+		if series+1+len(job.factors) > sc.maxSeries {
+			dropped++
+			continue
+		}
+		series += 1 + len(job.factors)
+		ch <- prometheus.MustNewConstMetric(sc.jobPriority, prometheus.GaugeValue, job.priority, job.jobID, job.user, job.partition, job.account)
+		for factor, value := range job.factors {
+			ch <- prometheus.MustNewConstMetric(sc.jobFactor, prometheus.GaugeValue, value, job.jobID, job.user, job.partition, job.account, factor)
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(sc.jobsDropped, prometheus.GaugeValue, float64(dropped))
+}
@@ -0,0 +1,45 @@
+// SPDX-FileCopyrightText: 2022 2022 Marshall Wace <opensource@mwam.com>
+//
+// SPDX-License-Identifier: GPL3
+
+package slurm
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSprioOutput(t *testing.T) {
+	jobs := ParseSprioOutput(readFile(sprioTestData))
+	assert.Len(t, jobs, 7)
+	job := jobs[2]
+	assert.Equal(t, "1005", job.jobID)
+	assert.Equal(t, "gpu", job.partition)
+	assert.Equal(t, "chemistry", job.account)
+	assert.Equal(t, 6500.0, job.priority)
+	assert.Equal(t, 2500.0, job.factors["fairshare"])
+	assert.Equal(t, 1000.0, job.factors["tres"])
+}
+
+func TestSprioCollector(t *testing.T) {
+	// One histogram for the priority and one per factor, for each of the
+	// normal/physics, normal/chemistry, gpu/chemistry and debug/physics pairs
+	assert.Equal(t, 4*(1+len(sprioFactors)), testutil.CollectAndCount(&scrapeCollector{ctx: context.Background(), collector: NewSprioCollector(true, 0)}))
+
+	// Two jobs fit in 16 series, the highest priorities are reported
+	collector := &scrapeCollector{ctx: context.Background(), collector: NewSprioCollector(true, 16)}
+	expected := `
+# HELP slurm_job_priority Priority of a pending job
+# TYPE slurm_job_priority gauge
+slurm_job_priority{account="physics",job_id="1003",partition="normal",user="alice"} 11250
+slurm_job_priority{account="physics",job_id="1050",partition="debug",user="dave"} 10725
+# HELP slurm_job_priority_jobs_dropped Pending jobs left out of the per job priority series to stay within the maximum number of series
+# TYPE slurm_job_priority_jobs_dropped gauge
+slurm_job_priority_jobs_dropped 5
+`
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(expected), "slurm_job_priority", "slurm_job_priority_jobs_dropped"))
+}
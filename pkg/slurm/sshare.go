@@ -3,54 +3,120 @@
 package slurm
 
 import (
+	"context"
 	"strconv"
 	"strings"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+const (
+	fairShareTestData = "test_data/sshare.txt"
+)
+
+var (
+	fairShareFields = []string{"Account", "User", "Partition", "RawShares", "NormShares", "RawUsage", "EffectvUsage", "FairShare", "LevelFS"}
+	// -m lists the partition specific associations of the users apart
+	fairShareCommand = "sshare -a -n -P -m -o " + strings.Join(fairShareFields, ",")
+)
+
+// FairShareMetrics describes an account or a user association of the sshare
+// tree. Values which are not reported, e.g. LevelFS without the Fair Tree
+// algorithm or RawShares inherited from the parent, are missing from values.
 type FairShareMetrics struct {
-	fairshare float64
+	account   string
+	user      string
+	partition string
+	parent    string
+	depth     int
+	values    map[string]float64
 }
 
-func ParseFairShareMetrics() map[string]*FairShareMetrics {
-	accounts := make(map[string]*FairShareMetrics)
-	out := execCommand("sshare -n -P -o account,fairshare")
-	lines := strings.Split(out, "\n")
-	for _, line := range lines {
-		if !strings.HasPrefix(line, "  ") {
-			if strings.Contains(line, "|") {
-				account := strings.Trim(strings.Split(line, "|")[0], " ")
-				_, key := accounts[account]
-				if !key {
-					accounts[account] = &FairShareMetrics{0}
-				}
-				fairshare, _ := strconv.ParseFloat(strings.Split(line, "|")[1], 64)
-				accounts[account].fairshare = fairshare
+func (fsc *FairShareCollector) FairShareGetMetrics(ctx context.Context) []*FairShareMetrics {
+	var shares []*FairShareMetrics
+	// Accounts are indented by one space per level of the tree, parents[d]
+	// is the last account seen at depth d
+	var parents []string
+	out := getData(ctx, fsc.isTest, fairShareCommand, fairShareTestData)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, "|")
+		if len(fields) < len(fairShareFields) {
+			continue
+		}
+		account := strings.TrimLeft(fields[0], " ")
+		fsm := &FairShareMetrics{
+			account:   account,
+			user:      fields[1],
+			partition: fields[2],
+			depth:     len(fields[0]) - len(account),
+			values:    map[string]float64{},
+		}
+		if fsm.depth > len(parents) {
+			continue
+		}
+		parents = parents[:fsm.depth]
+		if fsm.user != "" {
+			fsm.parent = account
+		} else {
+			if fsm.depth > 0 {
+				fsm.parent = parents[fsm.depth-1]
+			}
+			parents = append(parents, account)
+		}
+		for i, field := range fairShareFields[3:] {
+			// e.g. `parent` for RawShares, `inf` is fine for LevelFS
+			if v, err := strconv.ParseFloat(fields[i+3], 64); err == nil {
+				fsm.values[field] = v
 			}
 		}
+		shares = append(shares, fsm)
 	}
-	return accounts
+	return shares
 }
 
 type FairShareCollector struct {
+	isTest    bool
 	fairshare *prometheus.Desc
+	info      *prometheus.Desc
+	values    map[string]*prometheus.Desc
 }
 
-func NewFairShareCollector() *FairShareCollector {
-	labels := []string{"account"}
+func NewFairShareCollector(isTest bool) *FairShareCollector {
+	labels := []string{"account", "user", "partition"}
 	return &FairShareCollector{
-		fairshare: prometheus.NewDesc("slurm_account_fairshare", "FairShare for account", labels, nil),
+		isTest:    isTest,
+		fairshare: prometheus.NewDesc("slurm_account_fairshare", "FairShare for account", []string{"account"}, nil),
+		info:      prometheus.NewDesc("slurm_share_info", "Position of the account or user association in the sshare tree", []string{"account", "user", "partition", "parent"}, nil),
+		values: map[string]*prometheus.Desc{
+			"RawShares":    prometheus.NewDesc("slurm_share_raw_shares", "Shares assigned to the association", labels, nil),
+			"NormShares":   prometheus.NewDesc("slurm_share_norm_shares", "Shares assigned to the association normalized to the total number of shares", labels, nil),
+			"RawUsage":     prometheus.NewDesc("slurm_share_raw_usage", "Decayed usage of the association", labels, nil),
+			"EffectvUsage": prometheus.NewDesc("slurm_share_effective_usage", "Usage of the association normalized to the usage of its siblings", labels, nil),
+			"FairShare":    prometheus.NewDesc("slurm_share_fairshare", "FairShare factor of the association", labels, nil),
+			"LevelFS":      prometheus.NewDesc("slurm_share_level_fs", "Fair Tree LevelFS of the association, compared to its siblings", labels, nil),
+		},
 	}
 }
 
 func (fsc *FairShareCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- fsc.fairshare
+	ch <- fsc.info
+	for _, field := range fairShareFields[3:] {
+		ch <- fsc.values[field]
+	}
 }
 
-func (fsc *FairShareCollector) Collect(ch chan<- prometheus.Metric) {
-	fsm := ParseFairShareMetrics()
-	for f := range fsm {
-		ch <- prometheus.MustNewConstMetric(fsc.fairshare, prometheus.GaugeValue, fsm[f].fairshare, f)
+func (fsc *FairShareCollector) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	for _, fsm := range fsc.FairShareGetMetrics(ctx) {
+		ch <- prometheus.MustNewConstMetric(fsc.info, prometheus.GaugeValue, 1, fsm.account, fsm.user, fsm.partition, fsm.parent)
+		for field, value := range fsm.values {
+			ch <- prometheus.MustNewConstMetric(fsc.values[field], prometheus.GaugeValue, value, fsm.account, fsm.user, fsm.partition)
+		}
+		// slurm_account_fairshare only ever covered the top of the tree. Fair
+		// Tree leaves FairShare empty for accounts, reported as 0 as it
+		// always was.
+		if fsm.user == "" && fsm.depth <= 1 {
+			ch <- prometheus.MustNewConstMetric(fsc.fairshare, prometheus.GaugeValue, fsm.values["FairShare"], fsm.account)
+		}
 	}
 }
@@ -0,0 +1,54 @@
+// SPDX-FileCopyrightText: 2022 2022 Marshall Wace <opensource@mwam.com>
+//
+// SPDX-License-Identifier: GPL3
+
+package slurm
+
+import (
+	"context"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFairShareGetMetrics(t *testing.T) {
+	collector := NewFairShareCollector(true)
+	shares := collector.FairShareGetMetrics(context.Background())
+	assert.Len(t, shares, 8)
+	parents := map[string]string{}
+	for _, fsm := range shares {
+		parents[fsm.account+"|"+fsm.user+"|"+fsm.partition] = fsm.parent
+	}
+	assert.Equal(t, map[string]string{
+		"root||":         "",
+		"root|root|":     "root",
+		"science||":      "root",
+		"physics||":      "science",
+		"physics|alice|": "physics",
+		"chemistry||":    "science",
+		"chemistry|bob|": "chemistry",
+		// Partition specific association
+		"chemistry|bob|gpu": "chemistry",
+	}, parents)
+
+	// RawShares inherited from the parent is not reported
+	_, ok := shares[2].values["RawShares"]
+	assert.False(t, ok)
+	assert.True(t, math.IsInf(shares[1].values["LevelFS"], 1))
+	assert.Equal(t, 0.75, shares[4].values["FairShare"])
+
+	// Every association has its own series
+	collector = NewFairShareCollector(true)
+	assert.Equal(t, 8, testutil.CollectAndCount(&scrapeCollector{ctx: context.Background(), collector: collector}, "slurm_share_info"))
+	// The accounts at the top keep their FairShare, 0 under Fair Tree
+	expected := `
+# HELP slurm_account_fairshare FairShare for account
+# TYPE slurm_account_fairshare gauge
+slurm_account_fairshare{account="root"} 0
+slurm_account_fairshare{account="science"} 0
+`
+	assert.NoError(t, testutil.CollectAndCompare(&scrapeCollector{ctx: context.Background(), collector: collector}, strings.NewReader(expected), "slurm_account_fairshare"))
+}
@@ -0,0 +1,190 @@
+// SPDX-FileCopyrightText: 2022 2022 Marshall Wace <opensource@mwam.com>
+//
+// SPDX-License-Identifier: GPL3
+
+package slurm
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	sstatCommand  = "sstat -a -n -P -o JobID,NTasks,AveRSS,MaxRSS,AveCPU,AveDiskRead,AveDiskWrite"
+	sstatTestData = "test_data/sstat.txt"
+)
+
+// liveJobUsage is the resource usage of a running job, summed over its steps.
+type liveJobUsage struct {
+	averageRSS float64
+	maxRSS     float64
+	cpuSeconds float64
+	diskRead   float64
+	diskWrite  float64
+}
+
+// ParseSstatOutput aggregates the usage of every step reported by sstat per
+// job. Per task averages are multiplied by the number of tasks of the step.
+func ParseSstatOutput(out string) map[string]*liveJobUsage {
+	jobs := make(map[string]*liveJobUsage)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, "|")
+		if len(fields) < 7 {
+			continue
+		}
+		jobID := strings.SplitN(fields[0], ".", 2)[0]
+		job, ok := jobs[jobID]
+		if !ok {
+			job = &liveJobUsage{}
+			jobs[jobID] = job
+		}
+		tasks, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			continue
+		}
+		if rss, ok := parseMemory(fields[2], 1); ok {
+			job.averageRSS += rss * tasks
+		}
+		if rss, ok := parseMemory(fields[3], 1); ok {
+			job.maxRSS = math.Max(job.maxRSS, rss)
+		}
+		if cpu, ok := parseSlurmDuration(fields[4]); ok {
+			job.cpuSeconds += cpu * tasks
+		}
+		if read, ok := parseMemory(fields[5], 1); ok {
+			job.diskRead += read * tasks
+		}
+		if write, ok := parseMemory(fields[6], 1); ok {
+			job.diskWrite += write * tasks
+		}
+	}
+	return jobs
+}
+
+type runningJob struct {
+	user      string
+	partition string
+}
+
+/*
+ * Implement the Prometheus Collector interface and feed the
+ * live usage of the running jobs into it.
+ * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
+ */
+
+type SstatCollector struct {
+	isTest  bool
+	maxJobs int
+	// Jobs are queried round-robin, maxJobs at a time; the usage of the
+	// others is the one from the last time they were queried.
+	mu         sync.Mutex
+	next       int
+	usage      map[string]*liveJobUsage
+	averageRSS *prometheus.Desc
+	maxRSS     *prometheus.Desc
+	cpuSeconds *prometheus.Desc
+	diskRead   *prometheus.Desc
+	diskWrite  *prometheus.Desc
+}
+
+// NewSstatCollector returns a collector querying sstat for at most maxJobs
+// running jobs per scrape, 0 meaning all of them.
+func NewSstatCollector(isTest bool, maxJobs int) *SstatCollector {
+	labels := []string{"job_id", "user", "partition"}
+	return &SstatCollector{
+		isTest:     isTest,
+		maxJobs:    maxJobs,
+		usage:      make(map[string]*liveJobUsage),
+		averageRSS: prometheus.NewDesc("slurm_job_memory_rss_average_bytes", "Average resident memory of the tasks of a running job, summed over its tasks", labels, nil),
+		maxRSS:     prometheus.NewDesc("slurm_job_memory_rss_max_bytes", "Maximum resident memory of any task of a running job", labels, nil),
+		cpuSeconds: prometheus.NewDesc("slurm_job_cpu_seconds_total", "CPU time consumed by a running job", labels, nil),
+		diskRead:   prometheus.NewDesc("slurm_job_disk_read_bytes_total", "Bytes read from disk by a running job", labels, nil),
+		diskWrite:  prometheus.NewDesc("slurm_job_disk_write_bytes_total", "Bytes written to disk by a running job", labels, nil),
+	}
+}
+
+// nextBatch returns the jobs to query during this scrape and forgets the usage
+// of the jobs which are not running anymore.
+func (sc *SstatCollector) nextBatch(running map[string]runningJob) []string {
+	ids := make([]string, 0, len(running))
+	for id := range running {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for id := range sc.usage {
+		if _, ok := running[id]; !ok {
+			delete(sc.usage, id)
+		}
+	}
+	if sc.maxJobs <= 0 || len(ids) <= sc.maxJobs {
+		sc.next = 0
+		return ids
+	}
+	if sc.next >= len(ids) {
+		sc.next = 0
+	}
+	batch := append([]string{}, ids[sc.next:]...)
+	if len(batch) > sc.maxJobs {
+		batch = batch[:sc.maxJobs]
+	} else {
+		batch = append(batch, ids[:sc.maxJobs-len(batch)]...)
+	}
+	sc.next = (sc.next + sc.maxJobs) % len(ids)
+	return batch
+}
+
+func (sc *SstatCollector) getUsage(ctx context.Context) (map[string]runningJob, map[string]*liveJobUsage) {
+	running := make(map[string]runningJob)
+	for _, job := range getJobs(ctx, sc.isTest).Jobs {
+		if job.JobState == "RUNNING" {
+			running[strconv.Itoa(job.JobID)] = runningJob{user: job.UserName, partition: job.Partition}
+		}
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	batch := sc.nextBatch(running)
+	if len(batch) > 0 {
+		var data string
+		if sc.isTest {
+			data = readFile(sstatTestData)
+		} else {
+			data = execCommandArgs(ctx, sstatCommand, "-j", strings.Join(batch, ","))
+		}
+		for id, usage := range ParseSstatOutput(data) {
+			if _, ok := running[id]; ok {
+				sc.usage[id] = usage
+			}
+		}
+	}
+	usage := make(map[string]*liveJobUsage, len(sc.usage))
+	for id, u := range sc.usage {
+		usage[id] = u
+	}
+	return running, usage
+}
+
+func (sc *SstatCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sc.averageRSS
+	ch <- sc.maxRSS
+	ch <- sc.cpuSeconds
+	ch <- sc.diskRead
+	ch <- sc.diskWrite
+}
+
+func (sc *SstatCollector) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	running, usage := sc.getUsage(ctx)
+	for id, u := range usage {
+		job := running[id]
+		ch <- prometheus.MustNewConstMetric(sc.averageRSS, prometheus.GaugeValue, u.averageRSS, id, job.user, job.partition)
+		ch <- prometheus.MustNewConstMetric(sc.maxRSS, prometheus.GaugeValue, u.maxRSS, id, job.user, job.partition)
+		ch <- prometheus.MustNewConstMetric(sc.cpuSeconds, prometheus.CounterValue, u.cpuSeconds, id, job.user, job.partition)
+		ch <- prometheus.MustNewConstMetric(sc.diskRead, prometheus.CounterValue, u.diskRead, id, job.user, job.partition)
+		ch <- prometheus.MustNewConstMetric(sc.diskWrite, prometheus.CounterValue, u.diskWrite, id, job.user, job.partition)
+	}
+}
@@ -0,0 +1,35 @@
+// SPDX-FileCopyrightText: 2022 2022 Marshall Wace <opensource@mwam.com>
+//
+// SPDX-License-Identifier: GPL3
+
+package slurm
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSstatOutput(t *testing.T) {
+	jobs := ParseSstatOutput(readFile(sstatTestData))
+	assert.Len(t, jobs, 2)
+	job := jobs["1001"]
+	assert.Equal(t, 3072.0*kibibyte+4*gibibyte, job.averageRSS)
+	assert.Equal(t, 2.0*gibibyte, job.maxRSS)
+	assert.Equal(t, 600.0+4*3600, job.cpuSeconds)
+	assert.Equal(t, 1.5*mebibyte+8*mebibyte, job.diskRead)
+}
+
+func TestSstatRoundRobin(t *testing.T) {
+	collector := NewSstatCollector(true, 2)
+	running := map[string]runningJob{"1": {}, "2": {}, "3": {}}
+	assert.Equal(t, []string{"1", "2"}, collector.nextBatch(running))
+	assert.Equal(t, []string{"3", "1"}, collector.nextBatch(running))
+	assert.Equal(t, []string{"2", "3"}, collector.nextBatch(running))
+
+	// Only running jobs are reported, whatever sstat returns
+	collector = NewSstatCollector(true, 0)
+	_, usage := collector.getUsage(context.Background())
+	assert.Len(t, usage, 2)
+}
@@ -0,0 +1,103 @@
+// SPDX-FileCopyrightText: 2022 2022 Marshall Wace <opensource@mwam.com>
+//
+// SPDX-License-Identifier: GPL3
+
+package slurm
+
+import (
+	"strconv"
+	"strings"
+)
+
+const (
+	kibibyte = 1024
+	mebibyte = 1024 * kibibyte
+)
+
+var memoryUnits = map[byte]float64{
+	'K': kibibyte,
+	'M': mebibyte,
+	'G': 1024 * mebibyte,
+	'T': 1024 * 1024 * mebibyte,
+	'P': 1024 * 1024 * 1024 * mebibyte,
+}
+
+// countUnits are the multipliers of the TRES which are not sizes, such as
+// `billing=1K`.
+var countUnits = map[byte]float64{
+	'K': 1e3,
+	'M': 1e6,
+	'G': 1e9,
+	'T': 1e12,
+	'P': 1e15,
+}
+
+// parseMemory converts a Slurm memory size such as `16G` or `1234K` to bytes.
+// Sizes without a unit are expressed in defaultUnit bytes.
+func parseMemory(value string, defaultUnit float64) (float64, bool) {
+	return parseQuantity(value, defaultUnit, memoryUnits)
+}
+
+// parseQuantity converts value, with an optional suffix of units, to the
+// number of defaultUnit it stands for when it has no suffix.
+func parseQuantity(value string, defaultUnit float64, units map[byte]float64) (float64, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	unit := defaultUnit
+	if u, ok := units[strings.ToUpper(value[len(value)-1:])[0]]; ok {
+		unit = u
+		value = value[:len(value)-1]
+	}
+	size, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, false
+	}
+	return size * unit, true
+}
+
+// tresSize tells whether a TRES is a size, which Slurm expresses in megabytes
+// when there is no unit: memory, file systems such as fs/disk and burst
+// buffers such as bb/datawarp.
+func tresSize(name string) bool {
+	return name == "mem" || strings.HasPrefix(name, "fs/") || strings.HasPrefix(name, "bb/")
+}
+
+// parseTRES parses a TRES string such as
+// `cpu=4,mem=16G,node=1,energy=1250,gres/gpu:a100=2,license/matlab=1,fs/disk=100G`.
+// Sizes are converted to bytes, their K, M, G, T and P units are binary. Other
+// values, counts and energy in joules, are kept as they are, only expanding the
+// decimal K, M, G, T and P multipliers. Entries which cannot be parsed are
+// skipped.
+func parseTRES(tres string) map[string]float64 {
+	values := map[string]float64{}
+	for _, entry := range strings.Split(tres, ",") {
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		name := strings.TrimSpace(kv[0])
+		if name == "" {
+			continue
+		}
+		v, ok := parseQuantity(kv[1], 1, countUnits)
+		if tresSize(name) {
+			v, ok = parseMemory(kv[1], mebibyte)
+		}
+		if ok {
+			values[name] = v
+		}
+	}
+	return values
+}
+
+// addTRES adds tres to the TRES accounted for under key.
+func addTRES(to map[string]map[string]float64, key string, tres map[string]float64) {
+	if to[key] == nil {
+		to[key] = map[string]float64{}
+	}
+	for name, value := range tres {
+		to[key][name] += value
+	}
+}
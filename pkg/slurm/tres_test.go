@@ -0,0 +1,52 @@
+// SPDX-FileCopyrightText: 2022 2022 Marshall Wace <opensource@mwam.com>
+//
+// SPDX-License-Identifier: GPL3
+
+package slurm
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTRES(t *testing.T) {
+	assert.Equal(t, map[string]float64{
+		"cpu":            4,
+		"mem":            16 * 1024 * mebibyte,
+		"energy":         1250,
+		"node":           1,
+		"billing":        1000,
+		"gres/gpu:a100":  2,
+		"license/matlab": 1,
+		"fs/disk":        100 * mebibyte,
+		"bb/datawarp":    1024 * 1024 * mebibyte,
+	}, parseTRES("cpu=4,mem=16G,energy=1250,node=1,billing=1K,gres/gpu:a100=2,license/matlab=1,fs/disk=100,bb/datawarp=1T"))
+	assert.Equal(t, map[string]float64{"cpu": 2}, parseTRES("cpu=2,mem=lots,=3,gpu"))
+	assert.Empty(t, parseTRES(""))
+}
+
+func TestNodesTRES(t *testing.T) {
+	nc := NewNodesCollector(true, "")
+	collector := &scrapeCollector{ctx: context.Background(), collector: nc}
+	// 6 series of the nodes n00*, with 3 TRES each, g001 and g002, both in
+	// use and configured
+	assert.Equal(t, 2*6*3+7+8+2*4, testutil.CollectAndCount(collector, "slurm_node_tres", "slurm_node_tres_used"))
+	tres := func(name, partition, tres string) float64 {
+		return testutil.ToFloat64(nc.scontrolNodeTRES.WithLabelValues(name, partition, tres))
+	}
+	used := func(name, partition, tres string) float64 {
+		return testutil.ToFloat64(nc.scontrolNodeTRESUsed.WithLabelValues(name, partition, tres))
+	}
+	assert.Equal(t, float64(500*1024*mebibyte), tres("g001", "gpu", "mem"))
+	assert.Equal(t, float64(1800*1024*mebibyte), tres("g001", "gpu", "fs/disk"))
+	assert.Equal(t, 4.0, tres("g001", "gpu", "gres/gpu:a100"))
+	assert.Equal(t, 2.0, tres("g001", "gpu", "gres/nic"))
+	assert.Equal(t, 62.5*1024*mebibyte, used("g001", "gpu", "mem"))
+	assert.Equal(t, 15320.0, used("g001", "gpu", "energy"))
+	assert.Equal(t, 2.0, used("g001", "gpu", "gres/gpu:a100"))
+	assert.Equal(t, 0.0, used("g001", "gpu", "gres/nic"))
+	assert.Equal(t, 16.0, used("n002", "debug", "cpu"))
+}
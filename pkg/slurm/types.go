@@ -0,0 +1,69 @@
+// SPDX-FileCopyrightText: 2022 2022 Marshall Wace <opensource@mwam.com>
+//
+// SPDX-License-Identifier: GPL3
+
+package slurm
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	infinite32 = 0xffffffff
+	noVal32    = 0xfffffffe
+)
+
+// slurmNumber decodes the numbers found in the JSON output of the Slurm
+// commands. Depending on the release they are plain numbers, strings such as
+// `UNLIMITED`, or objects like {"set": true, "infinite": false, "number": 10}.
+type slurmNumber struct {
+	value    float64
+	set      bool
+	infinite bool
+}
+
+func (n *slurmNumber) UnmarshalJSON(data []byte) error {
+	*n = slurmNumber{}
+	var raw interface{}
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+	switch v := raw.(type) {
+	case float64:
+		// 32 bit fields dumped as plain numbers use INFINITE and NO_VAL
+		switch v {
+		case infinite32:
+			n.set, n.infinite = true, true
+		case noVal32:
+		default:
+			n.value, n.set = v, true
+		}
+	case string:
+		switch strings.ToUpper(v) {
+		case "UNLIMITED", "INFINITE":
+			n.set, n.infinite = true, true
+		default:
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				n.value, n.set = f, true
+			}
+		}
+	case map[string]interface{}:
+		n.set, _ = v["set"].(bool)
+		n.infinite, _ = v["infinite"].(bool)
+		n.value, _ = v["number"].(float64)
+	}
+	return nil
+}
+
+// Float returns the number, +Inf when it is infinite, and whether it is set at
+// all.
+func (n slurmNumber) Float() (float64, bool) {
+	if n.infinite {
+		return math.Inf(1), n.set
+	}
+	return n.value, n.set
+}
@@ -3,6 +3,7 @@
 package slurm
 
 import (
+	"context"
 	"regexp"
 	"strconv"
 	"strings"
@@ -17,9 +18,9 @@ type UserJobMetrics struct {
 	suspended    float64
 }
 
-func ParseUsersMetrics() map[string]*UserJobMetrics {
+func ParseUsersMetrics(ctx context.Context) map[string]*UserJobMetrics {
 	users := make(map[string]*UserJobMetrics)
-	out := execCommand("squeue -a -r -h -o %A|%u|%T|%C")
+	out := execCommand(ctx, "squeue -a -r -h -o %i|%u|%T|%C")
 	lines := strings.Split(out, "\n")
 	for _, line := range lines {
 		if strings.Contains(line, "|") {
@@ -31,6 +32,13 @@ func ParseUsersMetrics() map[string]*UserJobMetrics {
 			state := strings.Split(line, "|")[2]
 			state = strings.ToLower(state)
 			cpus, _ := strconv.ParseFloat(strings.Split(line, "|")[3], 64)
+			// The other components of a heterogeneous job only add CPUs
+			if hetJobComponent(strings.Split(line, "|")[0]) {
+				if strings.HasPrefix(state, "running") {
+					users[user].running_cpus += cpus
+				}
+				continue
+			}
 			pending := regexp.MustCompile(`^pending`)
 			running := regexp.MustCompile(`^running`)
 			suspended := regexp.MustCompile(`^suspended`)
@@ -72,8 +80,8 @@ func (uc *UsersCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- uc.suspended
 }
 
-func (uc *UsersCollector) Collect(ch chan<- prometheus.Metric) {
-	um := ParseUsersMetrics()
+func (uc *UsersCollector) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	um := ParseUsersMetrics(ctx)
 	for u := range um {
 		if um[u].pending > 0 {
 			ch <- prometheus.MustNewConstMetric(uc.pending, prometheus.GaugeValue, um[u].pending, u)